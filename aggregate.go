@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Default prefix lengths of the networks addresses are aggregated into.
+const (
+	DEFAULT_PREFIX_LENGTH      = 24
+	DEFAULT_IPV6_PREFIX_LENGTH = 64
+)
+
+// Aggregation is the policy for banning a whole network, instead of single
+// addresses, when enough addresses from it have been banned within a window.
+type Aggregation struct {
+	sync.Mutex
+	// PrefixLength and IPv6PrefixLength are the size of the networks.
+	PrefixLength     int
+	IPv6PrefixLength int
+	// Addresses is how many banned addresses make the network banned.
+	Addresses int
+	Window    time.Duration
+	// Blockers are the blockers the networks are added to, for BanTime.
+	Blockers Blockers
+	BanTime  time.Duration
+	// Shared is true when the blockers are the ones of the source.
+	Shared bool
+	// banned maps every network to its banned addresses and when they were.
+	banned map[string]map[string]time.Time
+	// networks maps the banned networks to the end of their ban; zero for
+	// a permanent ban.
+	networks map[string]time.Time
+	purged   time.Time
+}
+
+// NewAggregation returns the aggregation policy from the configuration, with
+// the given blockers and ban time of the source as defaults.
+func NewAggregation(config *AggregateConfig, blockers Blockers, banTime time.Duration) (*Aggregation, error) {
+	a := &Aggregation{
+		PrefixLength:     config.PrefixLength,
+		IPv6PrefixLength: config.IPv6PrefixLength,
+		Addresses:        config.Addresses,
+		banned:           make(map[string]map[string]time.Time),
+		networks:         make(map[string]time.Time),
+	}
+	// Without sets of its own, the networks go into the blockers of the
+	// source.
+	if config.Set != nil {
+		set := *config.Set
+		a.Blockers = append(a.Blockers, &set)
+	}
+	for i := range config.Sets {
+		set := config.Sets[i]
+		a.Blockers = append(a.Blockers, &set)
+	}
+	if len(a.Blockers) == 0 {
+		a.Blockers = blockers
+		a.Shared = true
+	}
+	if a.PrefixLength == 0 {
+		a.PrefixLength = DEFAULT_PREFIX_LENGTH
+	}
+	if a.IPv6PrefixLength == 0 {
+		a.IPv6PrefixLength = DEFAULT_IPV6_PREFIX_LENGTH
+	}
+	if a.PrefixLength < 0 || a.PrefixLength > 32 {
+		return nil, fmt.Errorf("invalid prefix_length %d", a.PrefixLength)
+	}
+	if a.IPv6PrefixLength < 0 || a.IPv6PrefixLength > 128 {
+		return nil, fmt.Errorf("invalid ipv6_prefix_length %d", a.IPv6PrefixLength)
+	}
+	if a.Addresses < 2 {
+		return nil, errors.New("aggregation needs at least 2 addresses")
+	}
+	window := config.FindWindow
+	if len(window) == 0 {
+		window = DEFAULT_FIND_WINDOW
+	}
+	var err error
+	a.Window, err = parseDuration(window)
+	if err != nil {
+		return nil, err
+	}
+	a.BanTime = banTime
+	if len(config.BanTime) > 0 {
+		a.BanTime, err = parseDuration(config.BanTime)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// The blockers of the source keep their addresses with their own timeouts.
+	a.Blockers.Require(a.BanTime > 0 || (a.Shared && banTime > 0), true)
+	return a, nil
+}
+
+// Network returns the network of the configured size the address belongs
+// to.
+func (a *Aggregation) Network(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		mask := net.CIDRMask(a.PrefixLength, 32)
+		return &net.IPNet{IP: ip4.Mask(mask), Mask: mask}
+	}
+	mask := net.CIDRMask(a.IPv6PrefixLength, 128)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
+
+// Covered returns the banned network the address belongs to, if any.
+func (a *Aggregation) Covered(ip net.IP, now time.Time) (*net.IPNet, bool) {
+	if a == nil {
+		return nil, false
+	}
+	network := a.Network(ip)
+	a.Lock()
+	defer a.Unlock()
+	until, found := a.networks[network.String()]
+	if !found {
+		return nil, false
+	}
+	if !until.IsZero() && !until.After(now) {
+		delete(a.networks, network.String())
+		return nil, false
+	}
+	return network, true
+}
+
+// Banned records the ban of the address, and returns its network together
+// with the banned addresses in it, when they are enough to ban the network.
+func (a *Aggregation) Banned(ip net.IP, now time.Time) (*net.IPNet, []net.IP) {
+	if a == nil {
+		return nil, nil
+	}
+	network := a.Network(ip)
+	a.Lock()
+	defer a.Unlock()
+	a.purge(now)
+	key := network.String()
+	addresses := a.banned[key]
+	if addresses == nil {
+		addresses = make(map[string]time.Time)
+		a.banned[key] = addresses
+	}
+	addresses[ip.String()] = now
+	a.expire(addresses, now)
+	if len(addresses) < a.Addresses {
+		return nil, nil
+	}
+	var neighbours []net.IP
+	for address := range addresses {
+		neighbours = append(neighbours, net.ParseIP(address))
+	}
+	delete(a.banned, key)
+	return network, neighbours
+}
+
+// Ban records the network as banned for the given time; zero is forever.
+func (a *Aggregation) Ban(network *net.IPNet, banTime time.Duration, now time.Time) {
+	a.Lock()
+	defer a.Unlock()
+	var until time.Time
+	if banTime > 0 {
+		until = now.Add(banTime)
+	}
+	a.networks[network.String()] = until
+}
+
+// Len returns the number of banned networks.
+func (a *Aggregation) Len() int {
+	if a == nil {
+		return 0
+	}
+	a.Lock()
+	defer a.Unlock()
+	return len(a.networks)
+}
+
+// expire removes the addresses banned before the window.
+func (a *Aggregation) expire(addresses map[string]time.Time, now time.Time) {
+	limit := now.Add(-a.Window)
+	for address, when := range addresses {
+		if !when.After(limit) {
+			delete(addresses, address)
+		}
+	}
+}
+
+// purge drops the networks without addresses banned within the window, and
+// the expired networks, at most once per window.
+func (a *Aggregation) purge(now time.Time) {
+	if now.Sub(a.purged) < a.Window {
+		return
+	}
+	for key, addresses := range a.banned {
+		a.expire(addresses, now)
+		if len(addresses) == 0 {
+			delete(a.banned, key)
+		}
+	}
+	for key, until := range a.networks {
+		if !until.IsZero() && !until.After(now) {
+			delete(a.networks, key)
+		}
+	}
+	a.purged = now
+}
@@ -3,43 +3,46 @@ package main
 import (
 	"net"
 	"sync"
+	"time"
 )
 
 // Blacklist is a simple structure for handling list of blacklisted IP addresses.
 type Blacklist struct {
 	sync.Mutex
 	addresses []net.IP
+	matches   []Match
 }
 
-// Add adds the given IP addresses to the list of addresses if not nil or
+// Match is a blacklisted address with the pattern and the line it was
+// matched by, the last one if it took more than one match, and the named
+// groups of the pattern, and when it happened.
+type Match struct {
+	Address net.IP
+	Pattern string
+	Line    string
+	Fields  map[string]string
+	Time    time.Time
+}
+
+// Add adds the given matches to the list of addresses if not nil or
 // duplicates.
-func (b *Blacklist) Add(addresses ...net.IP) {
+func (b *Blacklist) Add(matches ...Match) {
 	b.Lock()
 	defer b.Unlock()
-	for _, address := range addresses {
-		if address == nil {
+	for _, match := range matches {
+		if match.Address == nil {
 			continue
 		}
-		if !contains(b.addresses, address) {
-			b.addresses = append(b.addresses, address)
+		if !contains(b.addresses, match.Address) {
+			b.addresses = append(b.addresses, match.Address)
+			b.matches = append(b.matches, match)
 		}
 	}
 }
 
-// Addresses returns the list of IP addresses in the blacklist.
-func (b *Blacklist) Addresses() []net.IP {
+// Matches returns the matches of the IP addresses in the blacklist.
+func (b *Blacklist) Matches() []Match {
 	b.Lock()
 	defer b.Unlock()
-	return b.addresses
-}
-
-// contains return true if the given IP address is already present in the
-// list of blacklisted IP addresses.
-func (b *Blacklist) contains(ip net.IP) bool {
-	for _, present := range b.addresses {
-		if present.Equal(ip) {
-			return true
-		}
-	}
-	return false
+	return b.matches
 }
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Blocking backends a source can use.
+const (
+	BACKEND_NFTABLES = "nftables"
+	BACKEND_IPSET    = "ipset"
+	BACKEND_MEMORY   = "memory"
+	BACKEND_FILE     = "file"
+)
+
+// Blocker is a backend blocking the addresses and networks added to it, like
+// a nftables set.
+type Blocker interface {
+	// Family is the type of the addresses the blocker takes (IPV4 or IPV6),
+	// or empty if it takes both.
+	Family() string
+	// Require tells the blocker that elements will be added with a timeout
+	// and/or as networks, so that Check can verify it supports them.
+	Require(timeout bool, networks bool)
+	// Check controls that the blocker can be used.
+	Check() error
+	// Add adds the networks, single addresses being networks with a full
+	// mask, for the given time (zero is forever) and returns the added ones.
+	Add(timeout time.Duration, networks ...*net.IPNet) ([]*net.IPNet, error)
+	// Remove removes the networks, if present, and returns the removed ones.
+	Remove(networks ...*net.IPNet) ([]*net.IPNet, error)
+	// List returns the blocked networks.
+	List() ([]*net.IPNet, error)
+	// Destroy releases whatever the blocker created, on shutdown.
+	Destroy() error
+	// String names the blocker in the logs.
+	String() string
+}
+
+// Blockers is the list of blockers of a source, at most one for each
+// family, so that every address goes into the blocker of its own family.
+type Blockers []Blocker
+
+// Require tells every blocker what it will be used for.
+func (blockers Blockers) Require(timeout bool, networks bool) {
+	for _, blocker := range blockers {
+		blocker.Require(timeout, networks)
+	}
+}
+
+// Check controls every blocker and that there are not two for the same
+// family.
+func (blockers Blockers) Check() error {
+	for _, blocker := range blockers {
+		err := blocker.Check()
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", blocker.String(), err)
+		}
+	}
+	return blockers.distinct()
+}
+
+// distinct returns an error if two blockers take the same family.
+func (blockers Blockers) distinct() error {
+	seen := make(map[string]Blocker)
+	for _, blocker := range blockers {
+		families := []string{blocker.Family()}
+		if len(blocker.Family()) == 0 {
+			families = []string{IPV4, IPV6}
+		}
+		for _, family := range families {
+			if other, found := seen[family]; found {
+				return fmt.Errorf("%s and %s both take %s addresses", other.String(), blocker.String(), family)
+			}
+			seen[family] = blocker
+		}
+	}
+	return nil
+}
+
+// For returns the blocker for the family of the given address; IPv4-mapped
+// IPv6 addresses are IPv4 ones.
+func (blockers Blockers) For(ip net.IP) (Blocker, bool) {
+	family := IPV6
+	if ip.To4() != nil {
+		family = IPV4
+	}
+	for _, blocker := range blockers {
+		if len(blocker.Family()) == 0 || blocker.Family() == family {
+			return blocker, true
+		}
+	}
+	return nil, false
+}
+
+// Destroy releases what the blockers created.
+func (blockers Blockers) Destroy() error {
+	var errs []error
+	for _, blocker := range blockers {
+		err := blocker.Destroy()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("could not tear down %s: %w", blocker.String(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// String returns the names of the blockers, for logging.
+func (blockers Blockers) String() string {
+	names := make([]string, len(blockers))
+	for i, blocker := range blockers {
+		names[i] = blocker.String()
+	}
+	return strings.Join(names, ", ")
+}
+
+// newBlockers returns the blockers of the backend selected in the
+// configuration of the source.
+func newBlockers(config *SourceConfig) (Blockers, error) {
+	var blockers Blockers
+	switch strings.ToLower(config.Backend) {
+	case "", BACKEND_NFTABLES:
+		if len(config.Set.Name) > 0 {
+			set := config.Set
+			blockers = append(blockers, &set)
+		}
+		for i := range config.Sets {
+			set := config.Sets[i]
+			blockers = append(blockers, &set)
+		}
+		if len(blockers) == 0 {
+			return nil, errors.New("missing nft set name")
+		}
+	case BACKEND_IPSET:
+		for i := range config.IPSets {
+			set := config.IPSets[i]
+			blockers = append(blockers, &set)
+		}
+		if len(blockers) == 0 {
+			return nil, errors.New("missing ipset")
+		}
+	case BACKEND_MEMORY:
+		blockers = append(blockers, NewMemoryBlocker(config.Name))
+	case BACKEND_FILE:
+		if len(config.BlacklistFile) == 0 {
+			return nil, errors.New("missing blacklist_file")
+		}
+		blockers = append(blockers, NewFileBlocker(config.BlacklistFile))
+	default:
+		return nil, fmt.Errorf("unknown backend %q", config.Backend)
+	}
+	return blockers, nil
+}
+
+// familyOf returns the family of the given network.
+func familyOf(network *net.IPNet) string {
+	if network.IP.To4() != nil {
+		return IPV4
+	}
+	return IPV6
+}
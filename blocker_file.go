@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// FileBlocker is a blocker writing the networks to a plain text file, one per
+// line, for other programs (web servers, firewalls on other hosts...) to use.
+// The end of a ban is written after the network, as a comment, so that the
+// list survives restarts; expired networks are dropped at the next write.
+type FileBlocker struct {
+	*MemoryBlocker
+	File string
+}
+
+// NewFileBlocker returns a blocker writing to the given file.
+func NewFileBlocker(file string) *FileBlocker {
+	return &FileBlocker{MemoryBlocker: NewMemoryBlocker(file), File: file}
+}
+
+// Check loads the networks already in the file, if any, and controls that
+// the file can be written.
+func (f *FileBlocker) Check() error {
+	err := f.load()
+	if err != nil {
+		return err
+	}
+	return f.write()
+}
+
+// Add adds the networks and writes the file.
+func (f *FileBlocker) Add(timeout time.Duration, networks ...*net.IPNet) ([]*net.IPNet, error) {
+	added, _ := f.MemoryBlocker.Add(timeout, networks...)
+	err := f.write()
+	if err != nil {
+		added = nil
+	}
+	return added, err
+}
+
+// Remove removes the networks and writes the file.
+func (f *FileBlocker) Remove(networks ...*net.IPNet) ([]*net.IPNet, error) {
+	removed, _ := f.MemoryBlocker.Remove(networks...)
+	if len(removed) == 0 {
+		return removed, nil
+	}
+	err := f.write()
+	if err != nil {
+		removed = nil
+	}
+	return removed, err
+}
+
+// String names the blocker.
+func (f *FileBlocker) String() string {
+	return "file:" + f.File
+}
+
+// load reads the networks in the file.
+func (f *FileBlocker) load() error {
+	file, err := os.Open(f.File)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	f.Lock()
+	defer f.Unlock()
+	scanner := bufio.NewScanner(file)
+	n := 0
+	for scanner.Scan() {
+		n++
+		entry, comment, _ := strings.Cut(scanner.Text(), "#")
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+		network, err := parseNetwork(entry)
+		if err != nil {
+			return fmt.Errorf("%s line %d: %w", f.File, n, err)
+		}
+		var until time.Time
+		if value, found := strings.CutPrefix(strings.TrimSpace(comment), "until "); found {
+			until, err = time.Parse(time.RFC3339, value)
+			if err != nil {
+				return fmt.Errorf("%s line %d: %w", f.File, n, err)
+			}
+		}
+		f.entries[network.String()] = memoryEntry{network: network, until: until}
+	}
+	return scanner.Err()
+}
+
+// write writes the networks whose ban has not expired to the file.
+func (f *FileBlocker) write() error {
+	networks, _ := f.List()
+	f.Lock()
+	var b strings.Builder
+	for _, network := range networks {
+		entry := f.entries[network.String()]
+		b.WriteString(network.String())
+		if !entry.until.IsZero() {
+			b.WriteString(" # until " + entry.until.Format(time.RFC3339))
+		}
+		b.WriteString("\n")
+	}
+	f.Unlock()
+	// Readable by the programs using the list.
+	return writeFile(f.File, []byte(b.String()), 0644, 0755)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryBlocker is a blocker keeping the networks in memory only; it blocks
+// nothing, but it is useful for trying patterns and for tests.
+type MemoryBlocker struct {
+	sync.Mutex
+	Name    string
+	entries map[string]memoryEntry
+}
+
+// memoryEntry is a network in the memory blocker with the end of its ban;
+// zero for no end.
+type memoryEntry struct {
+	network *net.IPNet
+	until   time.Time
+}
+
+// NewMemoryBlocker returns an empty memory blocker.
+func NewMemoryBlocker(name string) *MemoryBlocker {
+	return &MemoryBlocker{Name: name, entries: make(map[string]memoryEntry)}
+}
+
+// Family is empty as the memory blocker takes both families.
+func (m *MemoryBlocker) Family() string {
+	return ""
+}
+
+// Require does nothing, as timeouts and networks are always supported.
+func (m *MemoryBlocker) Require(timeout bool, networks bool) {}
+
+// Check never fails.
+func (m *MemoryBlocker) Check() error {
+	return nil
+}
+
+// Add adds the networks with the given timeout.
+func (m *MemoryBlocker) Add(timeout time.Duration, networks ...*net.IPNet) ([]*net.IPNet, error) {
+	m.Lock()
+	defer m.Unlock()
+	var until time.Time
+	if timeout > 0 {
+		until = time.Now().Add(timeout)
+	}
+	for _, network := range networks {
+		m.entries[network.String()] = memoryEntry{network: network, until: until}
+	}
+	return networks, nil
+}
+
+// Remove removes the networks that are present.
+func (m *MemoryBlocker) Remove(networks ...*net.IPNet) ([]*net.IPNet, error) {
+	m.Lock()
+	defer m.Unlock()
+	m.expire(time.Now())
+	var removed []*net.IPNet
+	for _, network := range networks {
+		if _, found := m.entries[network.String()]; found {
+			delete(m.entries, network.String())
+			removed = append(removed, network)
+		}
+	}
+	return removed, nil
+}
+
+// List returns the networks whose ban has not expired, sorted.
+func (m *MemoryBlocker) List() ([]*net.IPNet, error) {
+	m.Lock()
+	defer m.Unlock()
+	m.expire(time.Now())
+	networks := make([]*net.IPNet, 0, len(m.entries))
+	for _, entry := range m.entries {
+		networks = append(networks, entry.network)
+	}
+	sort.Slice(networks, func(i, j int) bool {
+		return networks[i].String() < networks[j].String()
+	})
+	return networks, nil
+}
+
+// Destroy does nothing.
+func (m *MemoryBlocker) Destroy() error {
+	return nil
+}
+
+// String names the blocker.
+func (m *MemoryBlocker) String() string {
+	return "memory:" + m.Name
+}
+
+// expire removes the networks whose ban has ended; the caller must hold the
+// lock.
+func (m *MemoryBlocker) expire(now time.Time) {
+	for key, entry := range m.entries {
+		if !entry.until.IsZero() && !entry.until.After(now) {
+			delete(m.entries, key)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"regexp"
+	"time"
+)
+
+// checkConfig validates the configuration file without watching anything:
+// unknown fields, patterns, whitelists, intervals and blockers. It prints
+// every problem found and returns the exit code of the command.
+func checkConfig(filename string) int {
+	var problems []string
+	config, err := loadConfig(filename, true)
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		problems = append(problems, typeErr.Errors...)
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", filename, err.Error())
+		return 1
+	}
+	_, errs := NewWhitelist(config.Whitelist, config.WhitelistFiles, nil)
+	for _, err := range errs {
+		problems = append(problems, fmt.Sprintf("global %s", err.Error()))
+	}
+	if len(config.Sources) == 0 {
+		problems = append(problems, "no sources")
+	}
+	names := make(map[string]bool)
+	for i, sourceConfig := range config.Sources {
+		name := sourceConfig.Name
+		if len(name) == 0 {
+			name = fmt.Sprintf("#%d", i+1)
+			problems = append(problems, fmt.Sprintf("source %s: missing name", name))
+		} else if names[name] {
+			// The name is the name of the state file too.
+			problems = append(problems, fmt.Sprintf("source %q: duplicate name", name))
+		}
+		names[name] = true
+		for _, err := range checkSource(sourceConfig) {
+			problems = append(problems, fmt.Sprintf("source %q: %s", name, err.Error()))
+		}
+	}
+	for _, problem := range problems {
+		fmt.Printf("%s: %s\n", filename, problem)
+	}
+	if len(problems) > 0 {
+		fmt.Printf("%s: %d problems found\n", filename, len(problems))
+		return 1
+	}
+	fmt.Printf("%s: configuration OK\n", filename)
+	return 0
+}
+
+// checkSource returns all the problems of the configuration of a source,
+// checking what Init would, without stopping at the first one nor changing
+// anything.
+func checkSource(config *SourceConfig) []error {
+	var errs []error
+	// The log files themselves may not exist yet.
+	errs = append(errs, checkLogFiles(logFiles(config))...)
+	_, err := observing(config.Mode)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	_, err = startAt(config.StartAt)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	_, _, err = following(config.Follow, config.PollInterval)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if len(config.StatsInterval) > 0 {
+		_, err = time.ParseDuration(config.StatsInterval)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid stats_interval: %w", err))
+		}
+	}
+	var timeout time.Duration
+	if len(config.BanTime) > 0 {
+		timeout, err = parseDuration(config.BanTime)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid ban_time %q: %w", config.BanTime, err))
+		}
+	}
+	if config.Escalation != nil {
+		escalation, err := NewEscalation(config.Escalation, timeout)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid escalation: %w", err))
+		} else {
+			timeout = escalation.Duration(1)
+		}
+	}
+	prefixLength := config.IPv6PrefixLength
+	if prefixLength < 0 || prefixLength > 128 {
+		errs = append(errs, fmt.Errorf("invalid ipv6_prefix_length %d", prefixLength))
+		prefixLength = 0
+	}
+	if prefixLength == 128 {
+		prefixLength = 0
+	}
+	_, _, err = newTimestamp(config)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	counter, err := newCounter(config.MaxMatches, config.FindWindow)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid threshold: %w", err))
+	}
+
+	blockers, err := newBlockers(config)
+	if err != nil {
+		errs = append(errs, err)
+	} else {
+		for _, blocker := range blockers {
+			blocker.Require(timeout > 0, prefixLength > 0 && blocker.Family() != IPV4)
+		}
+		var aggregation *Aggregation
+		if config.Aggregate != nil {
+			aggregation, err = NewAggregation(config.Aggregate, blockers, timeout)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid aggregate: %w", err))
+			}
+		}
+		errs = append(errs, verify(blockers)...)
+		if aggregation != nil && !aggregation.Shared {
+			for _, err := range verify(aggregation.Blockers) {
+				errs = append(errs, fmt.Errorf("invalid aggregate: %w", err))
+			}
+		}
+	}
+
+	patterns, definitions, err := sourcePatterns(config)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if len(config.Preset) > 0 && err == nil {
+		preset, err := LoadPreset(config.Preset)
+		if err == nil {
+			for _, err := range preset.Verify() {
+				errs = append(errs, fmt.Errorf("preset %s: %w", preset.Name, err))
+			}
+		}
+	}
+	if len(patterns) == 0 {
+		errs = append(errs, errors.New("no patterns"))
+	}
+	// Patterns are named by their regexp, as the ones with unknown fields
+	// are not decoded.
+	for _, pattern := range patterns {
+		expanded, err := expand(pattern.Regexp, definitions)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("pattern %q: %w", pattern.Regexp, err))
+			continue
+		}
+		r, err := regexp.Compile(expanded)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("pattern %q: %w", pattern.Regexp, err))
+			continue
+		}
+		if len(addressGroups(r)) == 0 {
+			errs = append(errs, fmt.Errorf("pattern %q has no capturing group for the address", pattern.Regexp))
+		}
+		_, err = newConditions(pattern.Conditions, r)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("pattern %q: %w", pattern.Regexp, err))
+		}
+		_, err = patternCounter(pattern, config, counter)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("pattern %q: invalid threshold: %w", pattern.Regexp, err))
+		}
+	}
+
+	ignore, err := compileIgnorePatterns(config)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	compiled, err := exampleSource(config.Name).compilePatterns(config)
+	if err == nil {
+		errs = append(errs, verifyExamples(config.Name, compiled, ignore, config.Examples)...)
+	}
+
+	_, whitelistErrs := NewWhitelist(config.Whitelist, config.WhitelistFiles, nil)
+	return append(errs, whitelistErrs...)
+}
+
+// verify controls the blockers without changing anything: a nftables set
+// to be created is only validated and a blacklist file only read.
+func verify(blockers Blockers) []error {
+	var errs []error
+	for _, blocker := range blockers {
+		var err error
+		switch b := blocker.(type) {
+		case *NftSet:
+			if b.Create {
+				err = b.validate()
+			} else {
+				err = b.Check()
+			}
+		case *FileBlocker:
+			err = b.load()
+		default:
+			err = b.Check()
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s: %w", blocker.String(), err))
+		}
+	}
+	err := blockers.distinct()
+	if err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// ADDRESS_GROUP is the name of the capturing group with the address; when a
+// pattern has none, every unnamed group is an address.
+const ADDRESS_GROUP = "ip"
+
+// Condition is a test on a named group of a pattern (user, port, service...)
+// which must pass for a match to count.
+type Condition struct {
+	Field  string
+	In     []string
+	NotIn  []string
+	Regexp *regexp.Regexp
+}
+
+// NewCondition returns the condition from the configuration, checking that
+// the pattern has the field.
+func NewCondition(config ConditionConfig, r *regexp.Regexp) (*Condition, error) {
+	if len(config.Field) == 0 {
+		return nil, errors.New("condition without field")
+	}
+	if config.Field == ADDRESS_GROUP || r.SubexpIndex(config.Field) < 0 {
+		return nil, fmt.Errorf("no group named %q for condition", config.Field)
+	}
+	c := &Condition{Field: config.Field, In: config.In, NotIn: config.NotIn}
+	if len(config.Regexp) > 0 {
+		var err error
+		c.Regexp, err = regexp.Compile(config.Regexp)
+		if err != nil {
+			return nil, fmt.Errorf("condition on %s: %w", config.Field, err)
+		}
+	}
+	if len(c.In) == 0 && len(c.NotIn) == 0 && c.Regexp == nil {
+		return nil, fmt.Errorf("condition on %s without in, not_in or regexp", config.Field)
+	}
+	return c, nil
+}
+
+// Passes returns true if the field, from the given fields of a match,
+// satisfies the condition; a group that took no part in the match is empty.
+func (c *Condition) Passes(fields map[string]string) bool {
+	value := fields[c.Field]
+	if len(c.In) > 0 && !slices.Contains(c.In, value) {
+		return false
+	}
+	if slices.Contains(c.NotIn, value) {
+		return false
+	}
+	if c.Regexp != nil && !c.Regexp.MatchString(value) {
+		return false
+	}
+	return true
+}
+
+// String describes the condition, for logging.
+func (c *Condition) String() string {
+	var parts []string
+	if len(c.In) > 0 {
+		parts = append(parts, fmt.Sprintf("in %v", c.In))
+	}
+	if len(c.NotIn) > 0 {
+		parts = append(parts, fmt.Sprintf("not in %v", c.NotIn))
+	}
+	if c.Regexp != nil {
+		parts = append(parts, fmt.Sprintf("matching %s", c.Regexp.String()))
+	}
+	return fmt.Sprintf("%s %s", c.Field, strings.Join(parts, " and "))
+}
+
+// newConditions returns the conditions of a pattern.
+func newConditions(configs []ConditionConfig, r *regexp.Regexp) ([]*Condition, error) {
+	var conditions []*Condition
+	for _, config := range configs {
+		condition, err := NewCondition(config, r)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, condition)
+	}
+	return conditions, nil
+}
+
+// passes returns the first condition failing on the fields, if any.
+func passes(conditions []*Condition, fields map[string]string) (*Condition, bool) {
+	for _, condition := range conditions {
+		if !condition.Passes(fields) {
+			return condition, false
+		}
+	}
+	return nil, true
+}
+
+// addressGroups returns the indexes of the groups with the address: the ones
+// named ADDRESS_GROUP or, without those, the unnamed ones.
+func addressGroups(r *regexp.Regexp) []int {
+	var named, unnamed []int
+	for i, name := range r.SubexpNames() {
+		switch {
+		case i == 0:
+			continue
+		case name == ADDRESS_GROUP:
+			named = append(named, i)
+		case len(name) == 0:
+			unnamed = append(unnamed, i)
+		}
+	}
+	if len(named) > 0 {
+		return named
+	}
+	return unnamed
+}
+
+// fields returns the named groups of a match, other than the address.
+func fields(r *regexp.Regexp, m []string) map[string]string {
+	var f map[string]string
+	for i, name := range r.SubexpNames() {
+		if len(name) == 0 || name == ADDRESS_GROUP || len(m[i]) == 0 {
+			continue
+		}
+		if f == nil {
+			f = make(map[string]string)
+		}
+		f[name] = m[i]
+	}
+	return f
+}
+
+// formatFields returns the fields as "name=value" pairs sorted by name.
+func formatFields(fields map[string]string) string {
+	pairs := make([]string, 0, len(fields))
+	for name, value := range fields {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, value))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
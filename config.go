@@ -3,14 +3,39 @@ package main
 import (
 	"gopkg.in/yaml.v3"
 
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
+)
+
+// DEFAULT_STATE_DIR is the parent of the directory where the state is kept
+// between restarts, when no state_dir is configured.
+const DEFAULT_STATE_DIR = "/var/lib/"
+
+// Modes of a source: enforce adds the addresses to the blockers, observe
+// only logs what would have been added.
+const (
+	MODE_ENFORCE = "enforce"
+	MODE_OBSERVE = "observe"
 )
 
 // Config is the general structure of the configuration file (a list of sources)
 type Config struct {
-	Sources []*SourceConfig `yaml:"sources,flow"`
+	Sources        []*SourceConfig `yaml:"sources,flow"`
+	StateDir       string          `yaml:"state_dir"`
+	Whitelist      []string        `yaml:"whitelist"`
+	WhitelistFiles []string        `yaml:"whitelist_files"`
+	// Definitions are the macros usable in the patterns of every source.
+	Definitions map[string]string `yaml:"definitions"`
 }
 
 // Syslog configuration for syslog.
@@ -23,28 +48,175 @@ type Syslog struct {
 // SourceConfig configuration entry for source.
 type SourceConfig struct {
 	sync.Mutex
-	Name          string   `yaml:"name"`
-	Set           NftSet   `yaml:"nftables_set"`
-	LogFile       string   `yaml:"logfile"`
-	Patterns      []string `yaml:"patterns"`
-	Syslog        Syslog   `yaml:"syslog"`
-	StatsInterval string   `yaml:"stats_interval"`
-	Whitelist     []string `yaml:"whitelist"`
+	Name             string            `yaml:"name"`
+	Backend          string            `yaml:"backend"`
+	Mode             string            `yaml:"mode"`
+	Set              NftSet            `yaml:"nftables_set"`
+	Sets             []NftSet          `yaml:"nftables_sets"`
+	IPSets           []IPSet           `yaml:"ipsets"`
+	BlacklistFile    string            `yaml:"blacklist_file"`
+	LogFile          string            `yaml:"logfile"`
+	LogFiles         []string          `yaml:"logfiles"`
+	Follow           string            `yaml:"follow"`
+	PollInterval     string            `yaml:"poll_interval"`
+	Patterns         []PatternConfig   `yaml:"patterns"`
+	Syslog           Syslog            `yaml:"syslog"`
+	StatsInterval    string            `yaml:"stats_interval"`
+	Whitelist        []string          `yaml:"whitelist"`
+	WhitelistFiles   []string          `yaml:"whitelist_files"`
+	MaxMatches       int               `yaml:"max_matches"`
+	FindWindow       string            `yaml:"find_window"`
+	BanTime          string            `yaml:"ban_time"`
+	Escalation       *EscalationConfig `yaml:"escalation"`
+	StartAt          string            `yaml:"start_at"`
+	ProtectLocal     bool              `yaml:"protect_local"`
+	Aggregate        *AggregateConfig  `yaml:"aggregate"`
+	IPv6PrefixLength int               `yaml:"ipv6_prefix_length"`
+	Definitions      map[string]string `yaml:"definitions"`
+	Preset           string            `yaml:"preset"`
+	Examples         []ExampleConfig   `yaml:"examples"`
+	IgnorePatterns   []string          `yaml:"ignore_patterns"`
+	TimestampFormat  string            `yaml:"timestamp_format"`
+	TimestampRegexp  string            `yaml:"timestamp_regexp"`
+	MaxAge           string            `yaml:"max_age"`
+}
+
+// AggregateConfig configuration entry for banning whole networks when
+// enough of their addresses have been banned.
+type AggregateConfig struct {
+	PrefixLength     int      `yaml:"prefix_length"`
+	IPv6PrefixLength int      `yaml:"ipv6_prefix_length"`
+	Addresses        int      `yaml:"addresses"`
+	FindWindow       string   `yaml:"find_window"`
+	BanTime          string   `yaml:"ban_time"`
+	Set              *NftSet  `yaml:"nftables_set"`
+	Sets             []NftSet `yaml:"nftables_sets"`
+}
+
+// EscalationConfig configuration entry for escalating the ban time of
+// repeat offenders.
+type EscalationConfig struct {
+	BanTimes   []string `yaml:"ban_times"`
+	Multiplier float64  `yaml:"multiplier"`
+	MaxBanTime string   `yaml:"max_ban_time"`
+}
+
+// PatternConfig configuration entry for a pattern.
+// It can be written either as a plain regexp string or as a mapping, when
+// the pattern needs its own threshold.
+type PatternConfig struct {
+	Regexp     string            `yaml:"regexp"`
+	MaxMatches int               `yaml:"max_matches"`
+	FindWindow string            `yaml:"find_window"`
+	Conditions []ConditionConfig `yaml:"conditions"`
+	Examples   []ExampleConfig   `yaml:"examples"`
+}
+
+// ExampleConfig configuration entry for a sample log line with all the
+// addresses the patterns must find in it; none if empty.
+type ExampleConfig struct {
+	Line      string   `yaml:"line"`
+	Addresses []string `yaml:"addresses"`
+}
+
+// ConditionConfig configuration entry for a condition on a named group of
+// a pattern: its value must be in the list, not in the other, and match the
+// regexp, whichever are given.
+type ConditionConfig struct {
+	Field  string   `yaml:"field"`
+	In     []string `yaml:"in"`
+	NotIn  []string `yaml:"not_in"`
+	Regexp string   `yaml:"regexp"`
+}
+
+// UnmarshalYAML allows a pattern to be a plain string.
+func (p *PatternConfig) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		return value.Decode(&p.Regexp)
+	}
+	type plain PatternConfig
+	return value.Decode((*plain)(p))
+}
+
+// patternFields returns the keys of the patterns in the document, and of
+// their conditions and examples, which are not fields of their struct.
+// Decoding a pattern through its node does not reject them, as the decoder
+// does with KnownFields.
+func patternFields(value *yaml.Node) []string {
+	var errs []string
+	for i, node := range value.Content {
+		if value.Kind == yaml.MappingNode && i%2 == 1 &&
+			value.Content[i-1].Value == "patterns" && node.Kind == yaml.SequenceNode {
+			for _, pattern := range node.Content {
+				errs = append(errs, knownFields(pattern, PatternConfig{})...)
+				errs = append(errs, nestedFields(pattern, "conditions", ConditionConfig{})...)
+				errs = append(errs, nestedFields(pattern, "examples", ExampleConfig{})...)
+			}
+			continue
+		}
+		errs = append(errs, patternFields(node)...)
+	}
+	return errs
+}
+
+// nestedFields returns the unknown keys of the mappings in the sequence
+// under the given key of the mapping.
+func nestedFields(value *yaml.Node, key string, v any) []string {
+	var errs []string
+	if value.Kind != yaml.MappingNode {
+		return errs
+	}
+	for i := 0; i+1 < len(value.Content); i += 2 {
+		if value.Content[i].Value != key || value.Content[i+1].Kind != yaml.SequenceNode {
+			continue
+		}
+		for _, node := range value.Content[i+1].Content {
+			errs = append(errs, knownFields(node, v)...)
+		}
+	}
+	return errs
+}
+
+// knownFields returns the keys of the mapping which are not fields of the
+// given struct, in the words of the decoder.
+func knownFields(value *yaml.Node, v any) []string {
+	var errs []string
+	if value.Kind != yaml.MappingNode {
+		return errs
+	}
+	fields := make(map[string]bool)
+	t := reflect.TypeOf(v)
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+		fields[name] = true
+	}
+	for i := 0; i < len(value.Content); i += 2 {
+		key := value.Content[i]
+		if !fields[key.Value] {
+			errs = append(errs, fmt.Sprintf("line %d: field %s not found in type %s", key.Line, key.Value, t.String()))
+		}
+	}
+	return errs
 }
 
 // parseConfig reads the configuration file and returns a list of sources to watch.
-func parseConfig(filename string) (sources []*Source, err error) {
-	config := Config{}
-	data, err := os.ReadFile(filename)
+// With dryRun every source only observes.
+func parseConfig(filename string, dryRun bool) (sources []*Source, err error) {
+	config, err := loadConfig(filename, false)
 	if err != nil {
 		return
 	}
-	err = yaml.Unmarshal(data, &config)
-	if err != nil {
-		return
+	var offences *Offences
+	var local *LocalAddresses
+	whitelist, errs := NewWhitelist(config.Whitelist, config.WhitelistFiles, log.Printf)
+	for _, err := range errs {
+		log.Printf("%s in global whitelist", err.Error())
 	}
 
 	for _, sourceConfig := range config.Sources {
+		if dryRun {
+			sourceConfig.Mode = MODE_OBSERVE
+		}
 		source, err := Init(sourceConfig)
 		if err != nil {
 			log.SetOutput(os.Stderr)
@@ -56,8 +228,106 @@ func parseConfig(filename string) (sources []*Source, err error) {
 			log.Print(err)
 			continue
 		} else {
+			source.StateFile = positionFile(config.StateDir, source.Name)
+			source.WhiteList.Parent = whitelist
+			if sourceConfig.ProtectLocal {
+				if local == nil {
+					local = &LocalAddresses{}
+					if err := local.Refresh(); err != nil {
+						source.Warningf("could not collect all local addresses: %s", err.Error())
+					}
+				}
+				source.Local = local
+			}
+			if source.Escalation != nil {
+				if offences == nil {
+					offences, err = LoadOffences(path.Join(config.StateDir, OFFENCES_FILE))
+					if err != nil {
+						source.Warningf("could not load offences: %s", err.Error())
+					}
+				}
+				source.Offences = offences
+			}
 			sources = append(sources, source)
 		}
 	}
 	return
 }
+
+// loadConfig reads the configuration file, with the defaults filled in.
+// If strict, unknown fields are errors.
+func loadConfig(filename string, strict bool) (*Config, error) {
+	config := &Config{}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(strict)
+	err = decoder.Decode(config)
+	// An empty file is an empty configuration.
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+	// The decoding goes on after a type error, which is returned together
+	// with the configuration for reporting all the problems.
+	var typeErr *yaml.TypeError
+	if err != nil && !errors.As(err, &typeErr) {
+		return nil, err
+	}
+	if strict {
+		err = strictPatterns(data, typeErr)
+	}
+	if len(config.StateDir) == 0 {
+		config.StateDir = path.Join(DEFAULT_STATE_DIR, path.Base(os.Args[0]))
+	}
+	// The definitions of a source take precedence over the global ones.
+	for _, sourceConfig := range config.Sources {
+		for name, definition := range config.Definitions {
+			if _, found := sourceConfig.Definitions[name]; found {
+				continue
+			}
+			if sourceConfig.Definitions == nil {
+				sourceConfig.Definitions = make(map[string]string)
+			}
+			sourceConfig.Definitions[name] = definition
+		}
+	}
+	return config, err
+}
+
+// strictPatterns adds the unknown fields of the patterns of the document to
+// the type error of its decoding, if any.
+func strictPatterns(data []byte, typeErr *yaml.TypeError) error {
+	var root yaml.Node
+	var errs []string
+	if yaml.Unmarshal(data, &root) == nil {
+		errs = patternFields(&root)
+	}
+	if typeErr != nil {
+		errs = append(typeErr.Errors, errs...)
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return &yaml.TypeError{Errors: errs}
+}
+
+// parseDuration is like time.ParseDuration, but it also accepts a whole
+// number of days ("2d") or weeks ("1w"), as ban times are usually that long.
+func parseDuration(value string) (time.Duration, error) {
+	units := map[string]time.Duration{
+		"d": 24 * time.Hour,
+		"w": 7 * 24 * time.Hour,
+	}
+	for suffix, unit := range units {
+		if n, found := strings.CutSuffix(value, suffix); found {
+			i, err := strconv.Atoi(n)
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration %q", value)
+			}
+			return time.Duration(i) * unit, nil
+		}
+	}
+	return time.ParseDuration(value)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PERMANENT is the keyword for a ban without timeout in the escalation steps.
+const PERMANENT = "permanent"
+
+// OFFENCES_FILE is the name of the file, in the state directory, where the
+// offences are kept between restarts.
+const OFFENCES_FILE = "offences.json"
+
+// Escalation is the policy deciding how long an address is banned according
+// to how many times it has been banned before.
+// Either a list of ban times, the last one repeating, or a multiplier applied
+// to the ban time of the source for every new offence, up to a maximum.
+// A zero duration means a permanent ban.
+type Escalation struct {
+	BanTimes   []time.Duration
+	BanTime    time.Duration
+	Multiplier float64
+	MaxBanTime time.Duration
+}
+
+// NewEscalation returns the escalation policy from the configuration, with
+// the given ban time of the source as base for the multiplier.
+func NewEscalation(config *EscalationConfig, banTime time.Duration) (*Escalation, error) {
+	e := &Escalation{BanTime: banTime, Multiplier: config.Multiplier}
+	for _, step := range config.BanTimes {
+		if strings.EqualFold(step, PERMANENT) {
+			e.BanTimes = append(e.BanTimes, 0)
+			continue
+		}
+		d, err := parseDuration(step)
+		if err != nil {
+			return nil, err
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("ban time %q must be positive", step)
+		}
+		e.BanTimes = append(e.BanTimes, d)
+	}
+	if len(config.MaxBanTime) > 0 && !strings.EqualFold(config.MaxBanTime, PERMANENT) {
+		d, err := parseDuration(config.MaxBanTime)
+		if err != nil {
+			return nil, err
+		}
+		e.MaxBanTime = d
+	}
+	switch {
+	case len(e.BanTimes) > 0 && e.Multiplier != 0:
+		return nil, errors.New("escalation with both ban_times and multiplier")
+	case len(e.BanTimes) == 0 && e.Multiplier < 1:
+		return nil, fmt.Errorf("escalation multiplier %v must be at least 1", e.Multiplier)
+	case len(e.BanTimes) == 0 && e.BanTime <= 0:
+		return nil, errors.New("escalation multiplier without ban_time")
+	}
+	return e, nil
+}
+
+// Duration returns the ban time for the given offence, starting from 1.
+func (e *Escalation) Duration(offence int) time.Duration {
+	if offence < 1 {
+		offence = 1
+	}
+	if len(e.BanTimes) > 0 {
+		return e.BanTimes[min(offence, len(e.BanTimes))-1]
+	}
+	d := float64(e.BanTime) * math.Pow(e.Multiplier, float64(offence-1))
+	if e.MaxBanTime > 0 && d > float64(e.MaxBanTime) {
+		return e.MaxBanTime
+	}
+	if d > math.MaxInt64 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(d)
+}
+
+// Offence is the record of the bans of an address.
+type Offence struct {
+	Count     int       `json:"count"`
+	Until     time.Time `json:"until"`
+	Permanent bool      `json:"permanent,omitempty"`
+}
+
+// Offences keeps the count of the bans of every address, shared by all the
+// sources and saved in a file so that it survives restarts.
+type Offences struct {
+	sync.Mutex
+	File    string
+	records map[string]*Offence
+}
+
+// LoadOffences reads the offences from the given file; a missing file is an
+// empty list of offences.
+func LoadOffences(file string) (*Offences, error) {
+	o := &Offences{File: file, records: make(map[string]*Offence)}
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return o, nil
+	}
+	if err != nil {
+		return o, err
+	}
+	err = json.Unmarshal(data, &o.records)
+	if o.records == nil {
+		o.records = make(map[string]*Offence)
+	}
+	return o, err
+}
+
+// BanTime returns the offence number and ban time the given address would get
+// if banned now. An address still serving a ban keeps its offence number and
+// gets the remaining time.
+func (o *Offences) BanTime(ip net.IP, e *Escalation, now time.Time) (int, time.Duration) {
+	o.Lock()
+	defer o.Unlock()
+	record := o.records[ip.String()]
+	if record == nil {
+		return 1, e.Duration(1)
+	}
+	if record.Permanent {
+		return record.Count, 0
+	}
+	if record.Until.After(now) {
+		return record.Count, record.Until.Sub(now)
+	}
+	return record.Count + 1, e.Duration(record.Count + 1)
+}
+
+// Record saves the ban of the given address as its offence number.
+func (o *Offences) Record(ip net.IP, offence int, banTime time.Duration, now time.Time) error {
+	o.Lock()
+	defer o.Unlock()
+	o.records[ip.String()] = &Offence{
+		Count:     offence,
+		Until:     now.Add(banTime),
+		Permanent: banTime == 0,
+	}
+	return o.save()
+}
+
+// Repeated returns the number of addresses banned more than once.
+func (o *Offences) Repeated() int {
+	if o == nil {
+		return 0
+	}
+	o.Lock()
+	defer o.Unlock()
+	n := 0
+	for _, record := range o.records {
+		if record.Count > 1 {
+			n++
+		}
+	}
+	return n
+}
+
+// save writes the offences to their file.
+func (o *Offences) save() error {
+	data, err := json.Marshal(o.records)
+	if err != nil {
+		return err
+	}
+	return writeState(o.File, data)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"log/syslog"
+	"net"
+	"regexp"
+	"slices"
+)
+
+// exampleSource returns a source for running patterns over sample lines:
+// it takes any address and does not log the invalid ones.
+func exampleSource(name string) *Source {
+	return &Source{
+		Name:     name,
+		Blockers: Blockers{NewMemoryBlocker(name)},
+		LogLevel: syslog.LOG_ERR,
+	}
+}
+
+// verify runs the patterns of the source over the examples and returns an
+// error for each example not yielding exactly the expected addresses.
+// The lines matching an ignore pattern yield none.
+func (source *Source) verify(examples []ExampleConfig) []error {
+	var errs []error
+	for _, example := range examples {
+		var expected []string
+		for _, address := range example.Addresses {
+			ip := net.ParseIP(address)
+			if ip == nil {
+				errs = append(errs, fmt.Errorf("invalid address %q in example %q", address, example.Line))
+				continue
+			}
+			expected = append(expected, normalize(ip).String())
+		}
+		var got []string
+		patterns := source.Patterns
+		if source.ignored(example.Line) != nil {
+			patterns = nil
+		}
+		for _, p := range patterns {
+			matches, _ := source.parse(example.Line, p)
+			for _, match := range matches {
+				if !slices.Contains(got, match.Address.String()) {
+					got = append(got, match.Address.String())
+				}
+			}
+		}
+		slices.Sort(expected)
+		slices.Sort(got)
+		if !slices.Equal(expected, got) {
+			errs = append(errs, fmt.Errorf("example %q yields %v instead of %v", example.Line, got, expected))
+		}
+	}
+	return errs
+}
+
+// verifyExamples runs the examples of the source over all its patterns, with
+// the ignore patterns, and those of each pattern over the pattern alone, and
+// returns the failures.
+// Whitelists do not apply, as examples are about the patterns.
+func verifyExamples(name string, patterns []*Pattern, ignore []*regexp.Regexp, examples []ExampleConfig) []error {
+	source := exampleSource(name)
+	source.Patterns = patterns
+	source.IgnorePatterns = ignore
+	errs := source.verify(examples)
+	source.IgnorePatterns = nil
+	for _, p := range patterns {
+		source.Patterns = []*Pattern{p}
+		for _, err := range source.verify(p.Examples) {
+			errs = append(errs, fmt.Errorf("pattern %s: %w", p.Regexp.String(), err))
+		}
+	}
+	return errs
+}
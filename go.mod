@@ -4,12 +4,13 @@ go 1.26
 
 require (
 	github.com/google/nftables v0.0.0-20201230142148-715e31cb3c31
+	github.com/klauspost/compress v1.18.0
+	github.com/mdlayher/netlink v0.0.0-20191009155606-de872b0d824b
 	golang.org/x/sys v0.0.0-20191029155521-f43be2a4598c
 	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
 )
 
 require (
 	github.com/koneu/natend v0.0.0-20150829182554-ec0926ea948d // indirect
-	github.com/mdlayher/netlink v0.0.0-20191009155606-de872b0d824b // indirect
 	golang.org/x/net v0.0.0-20191028085509-fe3aa8a45271 // indirect
 )
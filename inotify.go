@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"strings"
+	"unsafe"
+)
+
+// Events watched on the log files and on their directories: a file is
+// renamed, or deleted, and then created again, another one is moved in its
+// place, or a new one matching a glob appears.
+const (
+	FILE_EVENTS      = unix.IN_MODIFY
+	DIRECTORY_EVENTS = unix.IN_CREATE | unix.IN_MOVED_TO | unix.IN_MOVED_FROM | unix.IN_DELETE |
+		unix.IN_DELETE_SELF | unix.IN_MOVE_SELF | unix.IN_ONLYDIR
+)
+
+// inotifyEvent is an event read from an inotify instance, with the name of
+// the file it is about when the watch is on a directory.
+type inotifyEvent struct {
+	Watch int
+	Mask  uint32
+	Name  string
+}
+
+// inotifyEventNames are the names of the events, for logging.
+var inotifyEventNames = []struct {
+	mask uint32
+	name string
+}{
+	{unix.IN_MODIFY, "IN_MODIFY"},
+	{unix.IN_CREATE, "IN_CREATE"},
+	{unix.IN_MOVED_FROM, "IN_MOVED_FROM"},
+	{unix.IN_MOVED_TO, "IN_MOVED_TO"},
+	{unix.IN_DELETE, "IN_DELETE"},
+	{unix.IN_DELETE_SELF, "IN_DELETE_SELF"},
+	{unix.IN_MOVE_SELF, "IN_MOVE_SELF"},
+	{unix.IN_IGNORED, "IN_IGNORED"},
+	{unix.IN_Q_OVERFLOW, "IN_Q_OVERFLOW"},
+}
+
+// String describes the event, for logging.
+func (e inotifyEvent) String() string {
+	var names []string
+	for _, n := range inotifyEventNames {
+		if e.Mask&n.mask != 0 {
+			names = append(names, n.name)
+		}
+	}
+	if len(names) == 0 {
+		names = append(names, fmt.Sprintf("%d", e.Mask))
+	}
+	desc := strings.Join(names, "|")
+	if len(e.Name) > 0 {
+		desc += fmt.Sprintf(" (%s)", e.Name)
+	}
+	return desc
+}
+
+// readEvents reads the next events from the inotify instance; a single read
+// may return more than one.
+func readEvents(fd int, buf []byte) ([]inotifyEvent, error) {
+	n, err := unix.Read(fd, buf)
+	if err != nil {
+		return nil, err
+	}
+	var events []inotifyEvent
+	for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+		raw := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+		event := inotifyEvent{Watch: int(raw.Wd), Mask: raw.Mask}
+		start := offset + unix.SizeofInotifyEvent
+		end := start + int(raw.Len)
+		if end > n {
+			return events, errors.New("truncated inotify event")
+		}
+		// The name is padded with NULs.
+		event.Name = string(bytes.TrimRight(buf[start:end], "\x00"))
+		events = append(events, event)
+		offset = end
+	}
+	return events, nil
+}
+
+// watchDirectory adds the watch on a directory of the log files, which
+// tells when they are rotated or created.
+func (source *Source) watchDirectory(dir string) error {
+	if source.Follow == FOLLOW_POLL {
+		return nil
+	}
+	wd, err := source.Watcher.Add(source, dir, DIRECTORY_EVENTS)
+	if err != nil {
+		return err
+	}
+	source.Directories[wd] = dir
+	return nil
+}
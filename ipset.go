@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+	"net"
+	"strings"
+	"time"
+)
+
+// ipset netlink protocol, from linux/netfilter/ipset/ip_set.h.
+const (
+	ipsetProtocol = 6
+
+	ipsetCmdList   = 7
+	ipsetCmdAdd    = 9
+	ipsetCmdDel    = 10
+	ipsetCmdHeader = 12
+
+	ipsetAttrProtocol = 1
+	ipsetAttrSetName  = 2
+	ipsetAttrTypeName = 3
+	ipsetAttrFamily   = 5
+	ipsetAttrData     = 7
+	ipsetAttrADT      = 8
+
+	ipsetAttrIP      = 1
+	ipsetAttrCIDR    = 3
+	ipsetAttrTimeout = 6
+
+	ipsetAttrIPv4 = 1
+	ipsetAttrIPv6 = 2
+
+	// ipsetErrExist is the error of deleting an element which is not there.
+	ipsetErrExist = 4103
+)
+
+// IPSet is a blocker adding the addresses to an ipset (hash:ip or hash:net)
+// for hosts still using iptables. The set must exist.
+type IPSet struct {
+	Name string `yaml:"name"`
+	Type string `yaml:"type"`
+	// timeout and networks are what the set must support.
+	timeout  bool
+	networks bool
+}
+
+// Family is the type of the set.
+func (s *IPSet) Family() string {
+	return strings.ToLower(s.Type)
+}
+
+// Require records what the set must support.
+func (s *IPSet) Require(timeout bool, networks bool) {
+	s.timeout = timeout
+	s.networks = networks
+}
+
+// Check controls that the set exists, is of the right family and supports
+// timeouts and networks, if required.
+func (s *IPSet) Check() error {
+	if len(s.Name) == 0 {
+		return errors.New("empty name for ipset")
+	}
+	family, err := s.family()
+	if err != nil {
+		return err
+	}
+	replies, err := s.execute(ipsetCmdHeader, 0, nil)
+	if err != nil {
+		return err
+	}
+	var typeName string
+	var setFamily uint8
+	for _, reply := range replies {
+		if len(reply.Data) < 4 {
+			continue
+		}
+		ad, err := netlink.NewAttributeDecoder(reply.Data[4:])
+		if err != nil {
+			return err
+		}
+		for ad.Next() {
+			switch ad.Type() {
+			case ipsetAttrTypeName:
+				typeName = ad.String()
+			case ipsetAttrFamily:
+				setFamily = ad.Uint8()
+			}
+		}
+	}
+	if setFamily != family {
+		return fmt.Errorf("ipset %s is not of type %s", s.Name, s.Type)
+	}
+	if s.networks && typeName != "hash:net" {
+		return fmt.Errorf("ipset %s is %s, hash:net required for networks", s.Name, typeName)
+	}
+	if s.timeout {
+		timeout, err := s.hasTimeout()
+		if err != nil {
+			return err
+		}
+		if !timeout {
+			return fmt.Errorf("ipset %s has no timeout, required by ban time", s.Name)
+		}
+	}
+	return nil
+}
+
+// Add adds the networks to the set with the given timeout.
+func (s *IPSet) Add(timeout time.Duration, networks ...*net.IPNet) ([]*net.IPNet, error) {
+	var added []*net.IPNet
+	for _, network := range networks {
+		if familyOf(network) != s.Family() {
+			continue
+		}
+		data, err := s.element(network, timeout)
+		if err != nil {
+			return added, err
+		}
+		_, err = s.execute(ipsetCmdAdd, 0, data)
+		if err != nil {
+			return added, err
+		}
+		added = append(added, network)
+	}
+	return added, nil
+}
+
+// Remove removes the networks from the set, ignoring the missing ones.
+func (s *IPSet) Remove(networks ...*net.IPNet) ([]*net.IPNet, error) {
+	var removed []*net.IPNet
+	for _, network := range networks {
+		if familyOf(network) != s.Family() {
+			continue
+		}
+		data, err := s.element(network, 0)
+		if err != nil {
+			return removed, err
+		}
+		_, err = s.execute(ipsetCmdDel, 0, data)
+		var opErr *netlink.OpError
+		if errors.As(err, &opErr) && opErr.Err == unix.Errno(ipsetErrExist) {
+			continue
+		}
+		if err != nil {
+			return removed, err
+		}
+		removed = append(removed, network)
+	}
+	return removed, nil
+}
+
+// List returns the networks in the set.
+func (s *IPSet) List() ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	replies, err := s.execute(ipsetCmdList, netlink.Dump, nil)
+	if err != nil {
+		return networks, err
+	}
+	for _, reply := range replies {
+		if len(reply.Data) < 4 {
+			continue
+		}
+		ad, err := netlink.NewAttributeDecoder(reply.Data[4:])
+		if err != nil {
+			return networks, err
+		}
+		for ad.Next() {
+			if ad.Type() != ipsetAttrADT {
+				continue
+			}
+			ad.Nested(func(adt *netlink.AttributeDecoder) error {
+				for adt.Next() {
+					adt.Nested(func(data *netlink.AttributeDecoder) error {
+						network := s.decodeElement(data)
+						if network != nil {
+							networks = append(networks, network)
+						}
+						return nil
+					})
+				}
+				return nil
+			})
+		}
+		if err := ad.Err(); err != nil {
+			return networks, err
+		}
+	}
+	return networks, nil
+}
+
+// Destroy does nothing, as the set is not created by us.
+func (s *IPSet) Destroy() error {
+	return nil
+}
+
+// String names the set.
+func (s *IPSet) String() string {
+	return "ipset:" + s.Name
+}
+
+// family returns the netfilter family of the set type.
+func (s *IPSet) family() (uint8, error) {
+	switch s.Family() {
+	case IPV4:
+		return unix.NFPROTO_IPV4, nil
+	case IPV6:
+		return unix.NFPROTO_IPV6, nil
+	}
+	return 0, fmt.Errorf("unhandled type %q for ipset", s.Type)
+}
+
+// hasTimeout returns true if the set has been created with a timeout, which
+// the kernel reports in the data of the header of the list.
+func (s *IPSet) hasTimeout() (bool, error) {
+	replies, err := s.execute(ipsetCmdList, netlink.Dump, nil)
+	if err != nil {
+		return false, err
+	}
+	for _, reply := range replies {
+		if len(reply.Data) < 4 {
+			continue
+		}
+		ad, err := netlink.NewAttributeDecoder(reply.Data[4:])
+		if err != nil {
+			return false, err
+		}
+		found := false
+		for ad.Next() {
+			if ad.Type() != ipsetAttrData {
+				continue
+			}
+			ad.Nested(func(data *netlink.AttributeDecoder) error {
+				for data.Next() {
+					if data.Type() == ipsetAttrTimeout {
+						found = true
+					}
+				}
+				return nil
+			})
+		}
+		if found {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// element encodes the data attribute of a network.
+func (s *IPSet) element(network *net.IPNet, timeout time.Duration) ([]netlink.Attribute, error) {
+	ip := network.IP.To4()
+	addrType := uint16(ipsetAttrIPv4)
+	if ip == nil {
+		ip = network.IP.To16()
+		addrType = ipsetAttrIPv6
+	}
+	address, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: addrType | unix.NLA_F_NET_BYTEORDER, Data: ip},
+	})
+	if err != nil {
+		return nil, err
+	}
+	attrs := []netlink.Attribute{
+		{Type: ipsetAttrIP | unix.NLA_F_NESTED, Data: address},
+	}
+	if !isHost(network) {
+		ones, _ := network.Mask.Size()
+		attrs = append(attrs, netlink.Attribute{Type: ipsetAttrCIDR, Data: []byte{uint8(ones)}})
+	}
+	if timeout > 0 {
+		seconds := make([]byte, 4)
+		binary.BigEndian.PutUint32(seconds, uint32(timeout.Seconds()))
+		attrs = append(attrs, netlink.Attribute{Type: ipsetAttrTimeout | unix.NLA_F_NET_BYTEORDER, Data: seconds})
+	}
+	data, err := netlink.MarshalAttributes(attrs)
+	if err != nil {
+		return nil, err
+	}
+	return []netlink.Attribute{{Type: ipsetAttrData | unix.NLA_F_NESTED, Data: data}}, nil
+}
+
+// decodeElement decodes a network from the data attribute of an element.
+func (s *IPSet) decodeElement(data *netlink.AttributeDecoder) *net.IPNet {
+	var ip net.IP
+	ones := -1
+	for data.Next() {
+		switch data.Type() {
+		case ipsetAttrIP:
+			data.Nested(func(address *netlink.AttributeDecoder) error {
+				for address.Next() {
+					ip = net.IP(address.Bytes())
+				}
+				return nil
+			})
+		case ipsetAttrCIDR:
+			ones = int(data.Uint8())
+		}
+	}
+	if ip == nil {
+		return nil
+	}
+	network := hostNetwork(ip)
+	if ones >= 0 {
+		_, bits := network.Mask.Size()
+		network.Mask = net.CIDRMask(ones, bits)
+	}
+	return network
+}
+
+// execute sends an ipset command about the set, with the given attributes,
+// and returns the replies.
+func (s *IPSet) execute(cmd uint16, flags netlink.HeaderFlags, attrs []netlink.Attribute) ([]netlink.Message, error) {
+	family, err := s.family()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := netlink.Dial(unix.NETLINK_NETFILTER, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	data, err := netlink.MarshalAttributes(append([]netlink.Attribute{
+		{Type: ipsetAttrProtocol, Data: []byte{ipsetProtocol}},
+		{Type: ipsetAttrSetName, Data: []byte(s.Name + "\x00")},
+	}, attrs...))
+	if err != nil {
+		return nil, err
+	}
+	// nfgenmsg header: family, version and resource id.
+	header := []byte{family, unix.NFNETLINK_V0, 0, 0}
+	return conn.Execute(netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType(unix.NFNL_SUBSYS_IPSET<<8 | cmd),
+			Flags: netlink.Request | netlink.Acknowledge | flags,
+		},
+		Data: append(header, data...),
+	})
+}
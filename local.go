@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// UTMP_FILE is the file listing the active login sessions.
+const UTMP_FILE = "/run/utmp"
+
+// LOCAL_REFRESH is how often the local addresses are collected again.
+// Short, as an admin may log in and mistype the password right after.
+const LOCAL_REFRESH = 10 * time.Second
+
+// utmpUserProcess is the ut_type of a user login session.
+const utmpUserProcess = 7
+
+// LocalAddresses is an implicit whitelist of the addresses of the host itself,
+// its gateways and the remote addresses of the active login sessions.
+// It is refreshed when checked, if older than LOCAL_REFRESH.
+type LocalAddresses struct {
+	sync.Mutex
+	Refreshed time.Time
+	// addresses maps each protected address to the reason for protecting it.
+	addresses map[string]string
+	// err is the error of the last refresh, if any.
+	err error
+}
+
+// ProtectedIn returns a protected address in the given network, with the
+// reason for protecting it, if there is one.
+func (l *LocalAddresses) ProtectedIn(network *net.IPNet) (string, string, bool) {
+	if l == nil {
+		return "", "", false
+	}
+	l.Lock()
+	defer l.Unlock()
+	if time.Since(l.Refreshed) > LOCAL_REFRESH {
+		l.refresh()
+	}
+	for address, reason := range l.addresses {
+		if network.Contains(net.ParseIP(address)) {
+			return address, reason, true
+		}
+	}
+	return "", "", false
+}
+
+// Refresh collects the local addresses again and returns the problems found.
+func (l *LocalAddresses) Refresh() error {
+	l.Lock()
+	defer l.Unlock()
+	l.refresh()
+	return l.err
+}
+
+// refresh collects the local addresses again; the caller must hold the lock.
+func (l *LocalAddresses) refresh() {
+	addresses := make(map[string]string)
+	var errs []error
+	for _, collect := range []func(map[string]string) error{
+		interfaceAddresses,
+		gatewayAddresses,
+		sessionAddresses,
+	} {
+		err := collect(addresses)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	l.addresses = addresses
+	l.err = errors.Join(errs...)
+	l.Refreshed = time.Now()
+}
+
+// interfaceAddresses adds the addresses of the network interfaces of the host.
+func interfaceAddresses(addresses map[string]string) error {
+	return dumpRIB(syscall.RTM_GETADDR, func(m syscall.NetlinkMessage, attrs []syscall.NetlinkRouteAttr) {
+		if m.Header.Type != syscall.RTM_NEWADDR {
+			return
+		}
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case syscall.IFA_ADDRESS, syscall.IFA_LOCAL:
+				addresses[normalize(net.IP(attr.Value)).String()] = "interface address"
+			}
+		}
+	})
+}
+
+// gatewayAddresses adds the gateways of the routes of the host.
+func gatewayAddresses(addresses map[string]string) error {
+	return dumpRIB(syscall.RTM_GETROUTE, func(m syscall.NetlinkMessage, attrs []syscall.NetlinkRouteAttr) {
+		if m.Header.Type != syscall.RTM_NEWROUTE {
+			return
+		}
+		for _, attr := range attrs {
+			if attr.Attr.Type == syscall.RTA_GATEWAY {
+				addresses[normalize(net.IP(attr.Value)).String()] = "gateway"
+			}
+		}
+	})
+}
+
+// dumpRIB requests a netlink dump and calls the given function for every
+// message with its attributes.
+func dumpRIB(proto int, f func(syscall.NetlinkMessage, []syscall.NetlinkRouteAttr)) error {
+	rib, err := syscall.NetlinkRIB(proto, syscall.AF_UNSPEC)
+	if err != nil {
+		return fmt.Errorf("netlink dump: %w", err)
+	}
+	messages, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return fmt.Errorf("netlink dump: %w", err)
+	}
+	for _, m := range messages {
+		if m.Header.Type == syscall.NLMSG_DONE {
+			break
+		}
+		attrs, err := syscall.ParseNetlinkRouteAttr(&m)
+		if err != nil {
+			continue
+		}
+		f(m, attrs)
+	}
+	return nil
+}
+
+// utmpEntry is the layout of a record in the utmp file on Linux.
+type utmpEntry struct {
+	Type    int16
+	_       [2]byte
+	Pid     int32
+	Line    [32]byte
+	ID      [4]byte
+	User    [32]byte
+	Host    [256]byte
+	Exit    [2]int16
+	Session int32
+	Time    [2]int32
+	Addr    [16]byte
+	_       [20]byte
+}
+
+// sessionAddresses adds the remote addresses of the active login sessions.
+func sessionAddresses(addresses map[string]string) error {
+	f, err := os.Open(UTMP_FILE)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for {
+		var entry utmpEntry
+		err = binary.Read(f, binary.LittleEndian, &entry)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", UTMP_FILE, err)
+		}
+		if entry.Type != utmpUserProcess {
+			continue
+		}
+		ip := net.IP(entry.Addr[:])
+		// An IPv4 address uses only the first 4 bytes.
+		if bytes.Equal(entry.Addr[4:], make([]byte, 12)) {
+			ip = net.IP(entry.Addr[:4])
+		}
+		if ip.IsUnspecified() {
+			// Some login programs only fill the host name.
+			ip = net.ParseIP(string(bytes.TrimRight(entry.Host[:], "\x00")))
+		}
+		if ip == nil || ip.IsUnspecified() {
+			continue
+		}
+		user := string(bytes.TrimRight(entry.User[:], "\x00"))
+		addresses[normalize(ip).String()] = fmt.Sprintf("session of %s", user)
+	}
+}
+
+// normalize returns an IPv4 address in its 4 bytes form, so that addresses
+// can be compared as strings.
+func normalize(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
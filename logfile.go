@@ -0,0 +1,384 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// LogFile is a file followed by a source: one of its log files or one
+// matching one of its globs.
+type LogFile struct {
+	Path string
+	// Literal is true for a log file configured by its path, which is
+	// waited for when missing; a file matching a glob is forgotten when
+	// deleted.
+	Literal bool
+	// File is the file being read, if it exists; it stays open when
+	// moved away, until the new one appears and it becomes Rotated.
+	// It is opened once for all the sources following it, which read it
+	// through shared.
+	File   *os.File
+	shared *sharedFile
+	// FileInfo is of the file being read or, without one, of the file
+	// which could not be opened, so that it is only tried again when
+	// replaced.
+	FileInfo        os.FileInfo
+	Pos             uint64
+	WatchDescriptor int
+	// Fingerprint is the hash of the first FingerprintSize bytes of the
+	// file, which finds it once rotated.
+	Fingerprint     string
+	FingerprintSize int
+	// Rotated is the file which was at Path before the current one, still
+	// read as its writer keeps writing to it until it reopens the log;
+	// it is closed when the new one is written to, or after
+	// ROTATION_GRACE since RotatedAt.
+	Rotated   *LogFile
+	RotatedAt time.Time
+}
+
+// ROTATION_GRACE is how long a rotated file is read, at most, when nothing
+// is written to the new one.
+const ROTATION_GRACE = time.Minute
+
+// isGlob returns true if the log file is a glob pattern.
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, `*?[\`)
+}
+
+// checkLogFiles controls the log files, or globs, of a source: their
+// directory must exist, as it is watched, and cannot be a glob.
+func checkLogFiles(logFiles []string) []error {
+	var errs []error
+	if len(logFiles) == 0 {
+		errs = append(errs, errors.New("no logfile"))
+	}
+	for _, pattern := range logFiles {
+		if isGlob(filepath.Dir(pattern)) {
+			errs = append(errs, fmt.Errorf("logfile %s: globs are only allowed in the file name", pattern))
+			continue
+		}
+		_, err := filepath.Match(pattern, "")
+		if err != nil {
+			errs = append(errs, fmt.Errorf("logfile %s: %w", pattern, err))
+			continue
+		}
+		_, err = os.Stat(filepath.Dir(pattern))
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// logFiles returns the log files of the source configuration, the single one
+// first.
+func logFiles(config *SourceConfig) []string {
+	var files []string
+	if len(config.LogFile) > 0 {
+		files = append(files, config.LogFile)
+	}
+	return append(files, config.LogFiles...)
+}
+
+// matches returns true if the path is one of the log files of the source, or
+// matches one of its globs.
+func (source *Source) matches(path string) bool {
+	for _, pattern := range source.LogFiles {
+		if pattern == path {
+			return true
+		}
+		if matched, _ := filepath.Match(pattern, path); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// directories returns the directories of the log files, once each.
+func (source *Source) directories() []string {
+	var dirs []string
+	for _, pattern := range source.LogFiles {
+		dir := filepath.Dir(pattern)
+		if !slices.Contains(dirs, dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// scan starts following the log files of the source and the existing files
+// matching its globs. The caller must hold the lock.
+func (source *Source) scan() error {
+	for _, pattern := range source.LogFiles {
+		paths := []string{pattern}
+		if isGlob(pattern) {
+			var err error
+			paths, err = filepath.Glob(pattern)
+			if err != nil {
+				return err
+			}
+		}
+		for _, path := range paths {
+			if _, found := source.Files[path]; found {
+				continue
+			}
+			// A followed file moved to a name matching a glob.
+			if fileInfo, err := os.Stat(path); err == nil {
+				if _, found := source.followedAs(fileInfo); found {
+					continue
+				}
+			}
+			f := &LogFile{Path: path, Literal: !isGlob(pattern), WatchDescriptor: -1}
+			err := source.open(f)
+			if err != nil {
+				return err
+			}
+			source.Files[path] = f
+		}
+	}
+	return nil
+}
+
+// follow starts following a file which appeared after the start, from its
+// beginning, unless it is a file already followed under another name.
+// The caller must hold the lock.
+func (source *Source) follow(path string) (*LogFile, error) {
+	fileInfo, err := os.Stat(path)
+	// Already gone.
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		source.Warningf("could not follow %s: %s", path, err.Error())
+		return nil, nil
+	}
+	if f, found := source.followedAs(fileInfo); found {
+		source.Debugf("file %s is %s moved", path, f.Path)
+		return nil, nil
+	}
+	f := &LogFile{Path: path, WatchDescriptor: -1}
+	err = source.open(f)
+	if err != nil || f.FileInfo == nil {
+		return nil, err
+	}
+	// Kept even if it could not be opened, as it matches a glob anyway.
+	source.Files[path] = f
+	if f.File != nil {
+		source.Infof("following new file %s", path)
+	}
+	return f, nil
+}
+
+// followedAs returns the followed file, or the rotated one, which is the
+// given file under another path. The caller must hold the lock.
+func (source *Source) followedAs(fileInfo os.FileInfo) (*LogFile, bool) {
+	for _, f := range source.Files {
+		if f.FileInfo != nil && os.SameFile(f.FileInfo, fileInfo) {
+			return f, true
+		}
+		if f.Rotated != nil && f.Rotated.FileInfo != nil && os.SameFile(f.Rotated.FileInfo, fileInfo) {
+			return f.Rotated, true
+		}
+	}
+	return nil, false
+}
+
+// files returns the files followed, sorted by path.
+func (source *Source) files() []*LogFile {
+	source.Lock()
+	defer source.Unlock()
+	files := slices.Collect(maps.Values(source.Files))
+	slices.SortFunc(files, func(a, b *LogFile) int { return strings.Compare(a.Path, b.Path) })
+	return files
+}
+
+// fileFor returns the followed file with the given watch descriptor.
+func (source *Source) fileFor(wd int) (*LogFile, bool) {
+	source.Lock()
+	defer source.Unlock()
+	for _, f := range source.Files {
+		if f.WatchDescriptor == wd {
+			return f, true
+		}
+		if f.Rotated != nil && f.Rotated.WatchDescriptor == wd {
+			return f.Rotated, true
+		}
+	}
+	return nil, false
+}
+
+// open opens the log file and watches it for new lines; a missing file is
+// not an error, it is waited for, and neither is a file which cannot be
+// opened, as one unreadable file must not stop the whole source.
+// The caller must hold the lock.
+func (source *Source) open(f *LogFile) error {
+	shared, err := source.Watcher.OpenFile(source, f.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		source.Infof("waiting for %s to be created", f.Path)
+		return nil
+	}
+	if err != nil {
+		source.Warningf("could not open %s, skipping it: %s", f.Path, err.Error())
+		f.FileInfo, _ = os.Stat(f.Path)
+		return nil
+	}
+	f.shared = shared
+	f.File = shared.File
+	f.FileInfo = shared.FileInfo
+	if source.Follow == FOLLOW_POLL {
+		return nil
+	}
+	// Through the descriptor, the watch is on the file just opened even if
+	// it has already been replaced.
+	f.WatchDescriptor, err = source.Watcher.Add(
+		source, fmt.Sprintf("/proc/self/fd/%d", f.File.Fd()), FILE_EVENTS,
+	)
+	if err != nil {
+		source.Watcher.ReleaseFile(source, shared)
+		f.File = nil
+		f.shared = nil
+		return err
+	}
+	return nil
+}
+
+// closeFile stops reading the log file, if open, and the one it replaced.
+// The caller must hold the lock.
+func (source *Source) closeFile(f *LogFile) {
+	if f.Rotated != nil {
+		source.closeFile(f.Rotated)
+		f.Rotated = nil
+	}
+	if f.File == nil {
+		f.FileInfo = nil
+		return
+	}
+	if f.WatchDescriptor >= 0 {
+		source.Watcher.Remove(source, f.WatchDescriptor)
+	}
+	source.Watcher.ReleaseFile(source, f.shared)
+	f.File = nil
+	f.shared = nil
+	f.FileInfo = nil
+	f.WatchDescriptor = -1
+	f.Fingerprint = ""
+	f.FingerprintSize = 0
+}
+
+// forget stops following a deleted file: a file matching a glob is dropped,
+// a log file is waited for. The caller must hold the lock.
+func (source *Source) forget(f *LogFile) {
+	source.closeFile(f)
+	if !f.Literal {
+		delete(source.Files, f.Path)
+		source.Infof("stopped following deleted file %s", f.Path)
+	}
+	source.savePosition()
+}
+
+// resync reads all the files, after inotify events have been lost: the new
+// files, the ones replaced and the ones matching a glob.
+func (source *Source) resync() error {
+	now := time.Now()
+	for _, f := range source.files() {
+		source.Blacklist(source.drain(f, now)...)
+		source.Blacklist(source.read(f)...)
+		err := source.Refresh(f)
+		if err != nil {
+			return err
+		}
+	}
+	source.Lock()
+	err := source.scan()
+	source.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, f := range source.files() {
+		source.Blacklist(source.read(f)...)
+	}
+	return nil
+}
+
+// Refresh switches to the file now at the path of the log file, if it is not
+// the one being read, from its beginning; the old one, read to the end
+// already, is kept as the rotated one.
+func (source *Source) Refresh(f *LogFile) error {
+	source.Lock()
+	defer source.Unlock()
+	fileInfo, err := os.Stat(f.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// The same file, being read or which could not be opened.
+	if f.FileInfo != nil && os.SameFile(fileInfo, f.FileInfo) {
+		return nil
+	}
+	if f.File != nil {
+		source.Infof("re-opening %s file", f.Path)
+		// Rotated again, before the previous one was done with.
+		if f.Rotated != nil {
+			source.closeFile(f.Rotated)
+		}
+		f.Rotated = &LogFile{
+			Path:            f.Path,
+			File:            f.File,
+			shared:          f.shared,
+			FileInfo:        f.FileInfo,
+			Pos:             f.Pos,
+			WatchDescriptor: f.WatchDescriptor,
+		}
+		f.RotatedAt = time.Now()
+		f.File = nil
+		f.shared = nil
+		f.WatchDescriptor = -1
+		f.Fingerprint = ""
+		f.FingerprintSize = 0
+	}
+	f.Pos = 0
+	err = source.open(f)
+	if err != nil {
+		return err
+	}
+	source.savePosition()
+	return nil
+}
+
+// drain reads what was written to the rotated file of the log file, if
+// any, and closes it once the new file has been written to, as its writer
+// has then reopened the log, or after ROTATION_GRACE.
+func (source *Source) drain(f *LogFile, now time.Time) []Match {
+	source.Lock()
+	rotated, since, current := f.Rotated, f.RotatedAt, f.File
+	source.Unlock()
+	if rotated == nil {
+		return nil
+	}
+	matches := source.read(rotated)
+	written := false
+	if current != nil {
+		fileInfo, err := current.Stat()
+		written = err == nil && fileInfo.Size() > 0
+	}
+	if !written && now.Sub(since) < ROTATION_GRACE {
+		return matches
+	}
+	source.Lock()
+	if f.Rotated == rotated {
+		source.closeFile(rotated)
+		f.Rotated = nil
+	}
+	source.Unlock()
+	source.Debugf("closed rotated file %s", f.Path)
+	return matches
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Patterns of the addresses, for the built-in macros. They are loose, as
+// the captured text is parsed as an address anyway, but an IPv6 address
+// needs all its eight groups, or a "::", not to match a time like 12:16:52.
+const (
+	IPV4_PATTERN = `(?:[0-9]{1,3}\.){3}[0-9]{1,3}`
+	IPV6_PATTERN = `(?:(?:[0-9A-Fa-f]{1,4}:){7}[0-9A-Fa-f]{1,4}` +
+		`|(?:[0-9A-Fa-f]{1,4}:){6}` + IPV4_PATTERN +
+		`|(?:[0-9A-Fa-f]{1,4}(?::[0-9A-Fa-f]{1,4}){0,6})?::` +
+		`(?:(?:[0-9A-Fa-f]{1,4}:){0,6}(?:` + IPV4_PATTERN + `|[0-9A-Fa-f]{1,4}))?)`
+)
+
+// MAX_EXPANSIONS limits the expansion of macros using other macros, so that
+// definitions referring to each other are an error rather than a loop.
+const MAX_EXPANSIONS = 10
+
+// macros are the built-in macros: the address, as the address group.
+var macros = map[string]string{
+	"HOST": fmt.Sprintf("(?P<%s>%s|%s)", ADDRESS_GROUP, IPV4_PATTERN, IPV6_PATTERN),
+	"IPV4": fmt.Sprintf("(?P<%s>%s)", ADDRESS_GROUP, IPV4_PATTERN),
+	"IPV6": fmt.Sprintf("(?P<%s>%s)", ADDRESS_GROUP, IPV6_PATTERN),
+}
+
+// macro matches a macro name between angle brackets, with what may come
+// before it when it is not a macro: the start of a named group, or a
+// backslash for a literal "<NAME>".
+var macro = regexp.MustCompile(`(\\|\(\?P?)?<([A-Z][A-Z0-9_]*)>`)
+
+// expand replaces the macros in the pattern, like <HOST>, with their
+// definition; the given definitions take precedence over the built-in ones.
+func expand(pattern string, definitions map[string]string) (string, error) {
+	for i := 0; i < MAX_EXPANSIONS; i++ {
+		var err error
+		expanded := macro.ReplaceAllStringFunc(pattern, func(m string) string {
+			sm := macro.FindStringSubmatch(m)
+			if len(sm[1]) > 0 {
+				return m
+			}
+			definition, found := definitions[sm[2]]
+			if !found {
+				definition, found = macros[sm[2]]
+			}
+			if !found && err == nil {
+				err = fmt.Errorf("undefined macro %s", m)
+			}
+			return definition
+		})
+		if err != nil {
+			return pattern, err
+		}
+		if expanded == pattern {
+			return expanded, nil
+		}
+		pattern = expanded
+	}
+	return pattern, fmt.Errorf("macros nested more than %d times", MAX_EXPANSIONS)
+}
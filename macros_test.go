@@ -0,0 +1,95 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestExpand(t *testing.T) {
+	host := macros["HOST"]
+	tests := []struct {
+		name        string
+		pattern     string
+		definitions map[string]string
+		want        string
+		fails       bool
+	}{
+		{"no macro", `from (\S+)`, nil, `from (\S+)`, false},
+		{"built-in macro", `from <HOST>`, nil, `from ` + host, false},
+		{"built-in macros", `<IPV4> to <IPV6>`, nil, macros["IPV4"] + ` to ` + macros["IPV6"], false},
+		{
+			"definition", `<CLIENT> rejected`,
+			map[string]string{"CLIENT": `\S+\[<HOST>\]`},
+			`\S+\[` + host + `\] rejected`, false,
+		},
+		{
+			"definition over a built-in macro", `from <HOST>`,
+			map[string]string{"HOST": `(?P<ip>\S+)`},
+			`from (?P<ip>\S+)`, false,
+		},
+		{
+			"nested definitions", `<A>`,
+			map[string]string{"A": `a<B>`, "B": `b<C>`, "C": `c`},
+			`abc`, false,
+		},
+		{"named group", `(?P<USER>\S+) from <HOST>`, nil, `(?P<USER>\S+) from ` + host, false},
+		{"short named group", `(?<USER>\S+)`, nil, `(?<USER>\S+)`, false},
+		{"escaped", `\<HOST> from <HOST>`, nil, `\<HOST> from ` + host, false},
+		{"lower case", `<host>`, nil, `<host>`, false},
+		{"undefined macro", `from <CLIENT>`, nil, "", true},
+		{
+			"definitions referring to each other", `<A>`,
+			map[string]string{"A": `<B>`, "B": `<A>`},
+			"", true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			expanded, err := expand(test.pattern, test.definitions)
+			if test.fails {
+				if err == nil {
+					t.Errorf("expand = %q, want an error", expanded)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expanded != test.want {
+				t.Errorf("expand = %q, want %q", expanded, test.want)
+			}
+		})
+	}
+}
+
+func TestAddressMacros(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"Accepted x at 192.0.2.1", "192.0.2.1"},
+		{"Accepted x at 2001:db8::7", "2001:db8::7"},
+		{"Accepted x at 2001:db8:0:0:0:0:0:7", "2001:db8:0:0:0:0:0:7"},
+		{"Accepted x at ::1", "::1"},
+		{"Accepted x at fe80::", "fe80::"},
+		{"Accepted x at ::ffff:192.0.2.1", "::ffff:192.0.2.1"},
+		{"Accepted x at 0:0:0:0:0:ffff:192.0.2.1", "0:0:0:0:0:ffff:192.0.2.1"},
+		{"Accepted x at 12:16:52", ""},
+		{"Accepted x at 2024:01:02:12:16:52", ""},
+	}
+	expanded, err := expand(`at <HOST>`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := regexp.MustCompile(expanded)
+	for _, test := range tests {
+		m := r.FindStringSubmatch(test.line)
+		got := ""
+		if m != nil {
+			got = m[r.SubexpIndex(ADDRESS_GROUP)]
+		}
+		if got != test.want {
+			t.Errorf("%q: captured %q, want %q", test.line, got, test.want)
+		}
+	}
+}
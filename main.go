@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"path"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -16,46 +18,110 @@ var dirs = []string{
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "test":
+			os.Exit(testPatterns(os.Args[2:]))
+		case "presets":
+			os.Exit(listPresets(os.Args[2:]))
+		}
+	}
 	var fileConfig string
+	var dryRun, check bool
 	flag.StringVar(&fileConfig, "config", "", "Configuration file")
+	flag.BoolVar(&dryRun, "dry-run", false, "Only log the addresses that would be blacklisted")
+	flag.BoolVar(&check, "check", false, "Check the configuration, report every problem and exit")
 	flag.Parse()
 	if len(fileConfig) == 0 {
-		filename := path.Base(os.Args[0]) + ".yaml"
-		for _, dir := range dirs {
-			fileConfig = path.Join(dir, filename)
-			_, err := os.Stat(fileConfig)
-			if err == nil {
-				break
-			}
-		}
+		fileConfig = defaultConfig()
+	}
+	if check {
+		os.Exit(checkConfig(fileConfig))
 	}
 
-	sources, err := parseConfig(fileConfig)
+	sources, err := parseConfig(fileConfig, dryRun)
 	if err != nil {
 		log.Fatal(err)
 	}
 	if len(sources) == 0 {
 		log.Fatal("No valid sources to watch")
 	}
+	watcher, err := NewWatcher()
+	if err != nil {
+		log.Fatal(err)
+	}
+	signalled := shutdown(sources, watcher)
 	var wg sync.WaitGroup
 	for _, source := range sources {
 		wg.Add(1)
-		go watch(source, &wg)
+		go watch(source, watcher, &wg)
+	}
+	// Without sources left, there is nothing to watch.
+	go func() {
+		wg.Wait()
+		watcher.Close()
+	}()
+	err = watcher.Run()
+	if err != nil {
+		log.Print(err)
 	}
 	wg.Wait()
+	select {
+	case <-signalled:
+		for _, source := range sources {
+			source.Teardown()
+		}
+	default:
+	}
+	for _, source := range sources {
+		source.Logger.Close()
+	}
+	if err != nil {
+		os.Exit(1)
+	}
+}
 
+// defaultConfig returns the configuration file in the default directories.
+func defaultConfig() string {
+	var fileConfig string
+	filename := path.Base(os.Args[0]) + ".yaml"
+	for _, dir := range dirs {
+		fileConfig = path.Join(dir, filename)
+		_, err := os.Stat(fileConfig)
+		if err == nil {
+			break
+		}
+	}
+	return fileConfig
 }
 
 // watch starts a go routine for watching a source.
-func watch(source *Source, wg *sync.WaitGroup) {
+func watch(source *Source, watcher *Watcher, wg *sync.WaitGroup) {
 	source.Info(
 		fmt.Sprintf("starting %s watch", source.Name),
 	)
 	go stats(source)
-	source.Watch()
+	source.Watch(watcher)
 	wg.Done()
 }
 
+// shutdown stops the watcher on a termination signal, so that the sources
+// save their state; the returned channel is closed then.
+func shutdown(sources []*Source, watcher *Watcher) <-chan struct{} {
+	signalled := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		for _, source := range sources {
+			source.Infof("ending %s watch on %s", source.Name, sig.String())
+		}
+		close(signalled)
+		watcher.Close()
+	}()
+	return signalled
+}
+
 // stats periodically logs the statistics for the source.
 func stats(s *Source) {
 	if s.Stats.Interval <= 0 {
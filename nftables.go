@@ -1,25 +1,94 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"github.com/google/nftables"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
 	"net"
 	"strings"
+	"time"
 )
 
 const IPV4 = "ipv4"
 const IPV6 = "ipv6"
 
+// nftables families a table can belong to.
+var families = map[string]nftables.TableFamily{
+	"ip":   nftables.TableFamilyIPv4,
+	"ip6":  nftables.TableFamilyIPv6,
+	"inet": nftables.TableFamilyINet,
+}
+
 // NftSet is a struct defining some of the properties of a nftables set.
+// It is the Blocker of the nftables backend.
 type NftSet struct {
 	Table string `yaml:"table"`
 	Name  string `yaml:"name"`
 	Type  string `yaml:"type"`
+	// TableFamily is the family of the table (ip, ip6 or inet), for when
+	// tables in different families have the same name. Empty for the first
+	// table with the name.
+	TableFamily string `yaml:"family"`
+	// Timeouts is true when elements are added with a timeout.
+	Timeouts bool `yaml:"-"`
+	// Interval is true when the set must hold networks, not just addresses.
+	Interval bool `yaml:"-"`
+	// Create makes the table and the set, and the chain if given, when they
+	// do not exist; Teardown removes what was created on shutdown.
+	Create   bool      `yaml:"create"`
+	Chain    *NftChain `yaml:"chain"`
+	Teardown bool      `yaml:"teardown"`
+	created  *nftCreated
+}
+
+// Family is the type of the set.
+func (s *NftSet) Family() string {
+	return strings.ToLower(s.Type)
+}
+
+// Require records the flags the set must have.
+func (s *NftSet) Require(timeout bool, networks bool) {
+	s.Timeouts = timeout
+	s.Interval = networks
+}
+
+// Check controls that a nftables exists or generate ones, if not and
+// creation is enabled.
+func (s *NftSet) Check() error {
+	err := s.validate()
+	if err != nil {
+		return err
+	}
+	if s.Create {
+		err := s.create()
+		if err != nil {
+			return err
+		}
+	}
+	set, err := s.Get()
+	if err != nil {
+		return err
+	}
+	flags, err := setFlags(set)
+	if err != nil {
+		return err
+	}
+	// The kernel refuses elements with a timeout on sets without the flag.
+	if s.Timeouts && flags&unix.NFT_SET_TIMEOUT == 0 {
+		return fmt.Errorf("set @%s has no timeout flag, required by ban time", s.Name)
+	}
+	if s.Interval && flags&unix.NFT_SET_INTERVAL == 0 {
+		return fmt.Errorf("set @%s has no interval flag, required for networks", s.Name)
+	}
+	return nil
 }
 
-// Check controls that a nftables exists or generate ones, if not.
-func (s NftSet) Check() error {
+// validate controls the configuration of the set, without looking for it.
+func (s *NftSet) validate() error {
 	// Must have a table and name, to begin with.
 	if len(s.Table) == 0 {
 		return errors.New("empty table name for nftables set")
@@ -36,41 +105,55 @@ func (s NftSet) Check() error {
 	default:
 		return fmt.Errorf("unhandled type %q for nftables set", s.Type)
 	}
-	_, err := s.Get()
-	return err
+	if _, found := families[strings.ToLower(s.TableFamily)]; len(s.TableFamily) > 0 && !found {
+		return fmt.Errorf("unhandled family %q for nftables set", s.TableFamily)
+	}
+	return nil
 }
 
-// Add adds the given address to the set.
-func (s NftSet) Add(addresses ...net.IP) ([]net.IP, error) {
-	var added []net.IP
+// Add adds the given networks to the set with the given timeout.
+// In an interval set a network is the range [first address, last address+1);
+// other sets only take single addresses.
+func (s *NftSet) Add(timeout time.Duration, networks ...*net.IPNet) ([]*net.IPNet, error) {
+	var added []*net.IPNet
 	set, err := s.Get()
 	if err != nil {
 		return added, err
 	}
+	interval, err := s.isInterval(set)
+	if err != nil {
+		return added, err
+	}
 	c := nftables.Conn{}
-	for _, address := range addresses {
-		switch strings.ToLower(s.Type) {
-		case IPV6:
-			address = address.To16()
-		case IPV4:
-			address = address.To4()
-		default:
-			return added, fmt.Errorf("unkown type %q for set %q", s.Type, s.Name)
-		}
-		if address != nil {
-			elements := make([]nftables.SetElement, 1)
-			element := nftables.SetElement{
-				Key: address,
-			}
-			elements[0] = element
-			err = c.SetAddElements(set, elements)
-			if err == nil {
-				added = append(added, address)
+	for _, network := range networks {
+		start, err := s.key(network.IP.Mask(network.Mask))
+		if err != nil {
+			return added, err
+		}
+		if start == nil {
+			continue
+		}
+		elements := []nftables.SetElement{{Key: start, Timeout: timeout}}
+		if interval {
+			end := nextIP(lastIP(start, network.Mask))
+			if end == nil {
+				return added, fmt.Errorf("no interval end for %s", network.String())
 			}
+			elements = append(elements, nftables.SetElement{Key: end, IntervalEnd: true})
+		} else if !isHost(network) {
+			return added, fmt.Errorf("set @%s is not an interval set for %s", s.Name, network.String())
 		}
-	}
-	if err != nil {
-		return added, err
+		// The library only sends the timeout of an element if the set has
+		// one, and it does not always decode the timeout flag of an existing
+		// set. Check has already verified the flag.
+		if timeout > 0 {
+			set.HasTimeout = true
+		}
+		err = c.SetAddElements(set, elements)
+		if err != nil {
+			return added, err
+		}
+		added = append(added, network)
 	}
 	err = c.Flush()
 	if err != nil {
@@ -79,29 +162,265 @@ func (s NftSet) Add(addresses ...net.IP) ([]net.IP, error) {
 	return added, err
 }
 
-// Get returns a pointer to the set.
-// One is created if doesn't exist already.
-func (s NftSet) Get() (set *nftables.Set, err error) {
-	var table *nftables.Table
+// Remove removes the given networks from the set, if present.
+func (s *NftSet) Remove(networks ...*net.IPNet) ([]*net.IPNet, error) {
+	var removed []*net.IPNet
+	set, err := s.Get()
+	if err != nil {
+		return removed, err
+	}
+	interval, err := s.isInterval(set)
+	if err != nil {
+		return removed, err
+	}
+	c := nftables.Conn{}
+	// Deleting a missing element fails the whole batch, so we only delete
+	// what is there (elements may have expired in the meantime).
+	present, err := c.GetSetElements(set)
+	if err != nil {
+		return removed, err
+	}
+	var elements []nftables.SetElement
+	for _, network := range networks {
+		key, err := s.key(network.IP.Mask(network.Mask))
+		if err != nil {
+			return removed, err
+		}
+		if key == nil || !hasElement(present, key, false) {
+			continue
+		}
+		if !interval {
+			elements = append(elements, nftables.SetElement{Key: key})
+			removed = append(removed, network)
+			continue
+		}
+		// In an interval set the start and the end go together.
+		end := nextIP(lastIP(key, network.Mask))
+		if end == nil || !hasElement(present, end, true) {
+			continue
+		}
+		elements = append(elements,
+			nftables.SetElement{Key: key},
+			nftables.SetElement{Key: end, IntervalEnd: true},
+		)
+		removed = append(removed, network)
+	}
+	if len(elements) == 0 {
+		return removed, nil
+	}
+	err = c.SetDeleteElements(set, elements)
+	if err == nil {
+		err = c.Flush()
+	}
+	if err != nil {
+		removed = nil
+	}
+	return removed, err
+}
 
-	c := &nftables.Conn{}
+// List returns the networks in the set. The intervals which are not a
+// network (e.g. added by hand as a range) are returned as their first address.
+func (s *NftSet) List() ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	set, err := s.Get()
+	if err != nil {
+		return networks, err
+	}
+	c := nftables.Conn{}
+	elements, err := c.GetSetElements(set)
+	if err != nil {
+		return networks, err
+	}
+	var ends []net.IP
+	for _, element := range elements {
+		if element.IntervalEnd {
+			ends = append(ends, net.IP(element.Key))
+		}
+	}
+	for _, element := range elements {
+		if element.IntervalEnd {
+			continue
+		}
+		start := net.IP(element.Key)
+		network := hostNetwork(start)
+		if end := firstAfter(ends, start); end != nil {
+			network = rangeNetwork(start, end)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
 
-	tables, err := c.ListTables()
+// String names the set.
+func (s *NftSet) String() string {
+	return "@" + s.Name
+}
+
+// key returns the given address in the form used by the set, or nil if it
+// is not of the same family of the set.
+func (s *NftSet) key(address net.IP) (net.IP, error) {
+	switch strings.ToLower(s.Type) {
+	case IPV6:
+		if address.To4() != nil {
+			return nil, nil
+		}
+		return address.To16(), nil
+	case IPV4:
+		return address.To4(), nil
+	}
+	return nil, fmt.Errorf("unkown type %q for set %q", s.Type, s.Name)
+}
+
+// isInterval returns true if the set has the interval flag.
+func (s *NftSet) isInterval(set *nftables.Set) (bool, error) {
+	flags, err := setFlags(set)
+	return flags&unix.NFT_SET_INTERVAL != 0, err
+}
+
+// Get returns a pointer to the set.
+func (s *NftSet) Get() (set *nftables.Set, err error) {
+	c := &nftables.Conn{}
+	table, err := s.table(c)
 	if err != nil {
 		return
 	}
+	return c.GetSetByName(table, s.Name)
+}
 
+// table returns the table of the set.
+func (s *NftSet) table(c *nftables.Conn) (*nftables.Table, error) {
+	tables, err := c.ListTables()
+	if err != nil {
+		return nil, err
+	}
+	family, filter := families[strings.ToLower(s.TableFamily)]
 	for _, t := range tables {
-		if t.Name == s.Table {
-			table = t
+		if t.Name == s.Table && (!filter || t.Family == family) {
+			return t, nil
+		}
+	}
+	if !filter {
+		return nil, fmt.Errorf("no table with name %s", s.Table)
+	}
+	return nil, fmt.Errorf("no %s table with name %s", s.TableFamily, s.Table)
+}
+
+// setFlags returns the flags of the set as the kernel reports them, as the
+// library does not decode all of them.
+func setFlags(set *nftables.Set) (uint32, error) {
+	conn, err := netlink.Dial(unix.NETLINK_NETFILTER, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	data, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: unix.NFTA_SET_TABLE, Data: []byte(set.Table.Name + "\x00")},
+		{Type: unix.NFTA_SET_NAME, Data: []byte(set.Name + "\x00")},
+	})
+	if err != nil {
+		return 0, err
+	}
+	// nfgenmsg header: family, version and resource id.
+	header := []byte{byte(set.Table.Family), unix.NFNETLINK_V0, 0, 0}
+	replies, err := conn.Execute(netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType((unix.NFNL_SUBSYS_NFTABLES << 8) | unix.NFT_MSG_GETSET),
+			Flags: netlink.Request | netlink.Acknowledge,
+		},
+		Data: append(header, data...),
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, reply := range replies {
+		if len(reply.Data) < 4 {
+			continue
+		}
+		ad, err := netlink.NewAttributeDecoder(reply.Data[4:])
+		if err != nil {
+			return 0, err
+		}
+		for ad.Next() {
+			if ad.Type() == unix.NFTA_SET_FLAGS {
+				return binary.BigEndian.Uint32(ad.Bytes()), nil
+			}
+		}
+	}
+	return 0, nil
+}
+
+// hasElement returns true if the elements contain the given key, as start
+// or end of an interval.
+func hasElement(elements []nftables.SetElement, key net.IP, intervalEnd bool) bool {
+	for _, element := range elements {
+		if element.IntervalEnd == intervalEnd && bytes.Equal(element.Key, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostNetwork returns the network made of the given address only.
+func hostNetwork(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// isHost returns true if the network is made of a single address.
+func isHost(network *net.IPNet) bool {
+	ones, bits := network.Mask.Size()
+	return ones == bits
+}
+
+// firstAfter returns the lowest of the addresses greater than the given one.
+func firstAfter(addresses []net.IP, ip net.IP) net.IP {
+	var first net.IP
+	for _, address := range addresses {
+		if bytes.Compare(address, ip) > 0 && (first == nil || bytes.Compare(address, first) < 0) {
+			first = address
+		}
+	}
+	return first
+}
+
+// rangeNetwork returns the network [start, end) if it is one, or the network
+// of the start address only.
+func rangeNetwork(start net.IP, end net.IP) *net.IPNet {
+	bits := len(start) * 8
+	for ones := bits; ones >= 0; ones-- {
+		mask := net.CIDRMask(ones, bits)
+		if !start.Mask(mask).Equal(start) {
 			break
 		}
+		if next := nextIP(lastIP(start, mask)); next != nil && next.Equal(end) {
+			return &net.IPNet{IP: start, Mask: mask}
+		}
 	}
+	return hostNetwork(start)
+}
 
-	if table == nil {
-		err = fmt.Errorf("no table with name %s", s.Table)
-		return
+// nextIP returns the address following the given one, or nil if there is none.
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			return next
+		}
 	}
+	return nil
+}
 
-	return c.GetSetByName(table, s.Name)
+// lastIP returns the last address of the network with the given start and mask.
+func lastIP(start net.IP, mask net.IPMask) net.IP {
+	last := make(net.IP, len(start))
+	// A 4 bytes address may come with a 16 bytes mask.
+	mask = mask[len(mask)-len(start):]
+	for i := range start {
+		last[i] = start[i] | ^mask[i]
+	}
+	return last
 }
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+	"strings"
+	"sync"
+)
+
+// DEFAULT_FAMILY is the family of the tables created when the set has none.
+const DEFAULT_FAMILY = "inet"
+
+// hooks are the hooks a chain created for dropping packets can be on.
+var hooks = map[string]nftables.ChainHook{
+	"prerouting": nftables.ChainHookPrerouting,
+	"input":      nftables.ChainHookInput,
+	"forward":    nftables.ChainHookForward,
+}
+
+// NftChain is the chain, with a rule dropping the packets from the addresses
+// in the set, created together with the set.
+type NftChain struct {
+	Name     string `yaml:"name"`
+	Hook     string `yaml:"hook"`
+	Priority int32  `yaml:"priority"`
+}
+
+// nftCreated keeps what has been created for a set, so that it can be
+// removed on shutdown. It is shared by all the copies of the set.
+type nftCreated struct {
+	sync.Mutex
+	table *nftables.Table
+	set   *nftables.Set
+	chain *nftables.Chain
+	rule  *nftables.Rule
+}
+
+// create creates the table, the set and the chain with its drop rule, if
+// they do not exist already.
+func (s *NftSet) create() error {
+	if s.created == nil {
+		s.created = &nftCreated{}
+	}
+	s.created.Lock()
+	defer s.created.Unlock()
+	c := &nftables.Conn{}
+	family := s.TableFamily
+	if len(family) == 0 {
+		family = DEFAULT_FAMILY
+	}
+	table, err := s.table(c)
+	if err != nil {
+		table = c.AddTable(&nftables.Table{
+			Name:   s.Table,
+			Family: families[strings.ToLower(family)],
+		})
+		s.created.table = table
+	}
+	set, err := c.GetSetByName(table, s.Name)
+	if err != nil {
+		keyType := nftables.TypeIPAddr
+		if strings.ToLower(s.Type) == IPV6 {
+			keyType = nftables.TypeIP6Addr
+		}
+		// Always with timeouts: elements without one never expire anyway.
+		set = &nftables.Set{
+			Table:      table,
+			Name:       s.Name,
+			KeyType:    keyType,
+			HasTimeout: true,
+			Interval:   s.Interval,
+		}
+		err = c.AddSet(set, nil)
+		if err != nil {
+			return err
+		}
+		s.created.set = set
+	}
+	err = c.Flush()
+	if err != nil {
+		return fmt.Errorf("could not create set @%s: %w", s.Name, err)
+	}
+	if s.Chain == nil {
+		return nil
+	}
+	return s.createChain(c, table, set)
+}
+
+// createChain creates the chain of the set, if missing, and adds the rule
+// dropping the packets from the addresses in the set, unless the chain has
+// one already.
+func (s *NftSet) createChain(c *nftables.Conn, table *nftables.Table, set *nftables.Set) error {
+	if len(s.Chain.Name) == 0 {
+		return errors.New("empty chain name")
+	}
+	hook := strings.ToLower(s.Chain.Hook)
+	if len(hook) == 0 {
+		hook = "input"
+	}
+	hooknum, found := hooks[hook]
+	if !found {
+		return fmt.Errorf("unhandled hook %q for chain %s", s.Chain.Hook, s.Chain.Name)
+	}
+	var chain *nftables.Chain
+	chains, err := c.ListChains()
+	if err != nil {
+		return err
+	}
+	for _, ch := range chains {
+		if ch.Name == s.Chain.Name && ch.Table.Name == table.Name && ch.Table.Family == table.Family {
+			chain = ch
+			break
+		}
+	}
+	if chain == nil {
+		chain = c.AddChain(&nftables.Chain{
+			Name:     s.Chain.Name,
+			Table:    table,
+			Type:     nftables.ChainTypeFilter,
+			Hooknum:  hooknum,
+			Priority: nftables.ChainPriority(s.Chain.Priority),
+		})
+		s.created.chain = chain
+	} else {
+		rules, err := c.GetRule(table, chain)
+		if err != nil {
+			return err
+		}
+		for _, rule := range rules {
+			for _, e := range rule.Exprs {
+				if lookup, ok := e.(*expr.Lookup); ok && lookup.SetName == set.Name {
+					return nil
+				}
+			}
+		}
+	}
+	s.created.rule = c.AddRule(&nftables.Rule{
+		Table: table,
+		Chain: chain,
+		Exprs: s.dropExprs(table, set),
+	})
+	err = c.Flush()
+	if err != nil {
+		return fmt.Errorf("could not create chain %s: %w", s.Chain.Name, err)
+	}
+	return nil
+}
+
+// dropExprs returns the expressions of the rule "ip saddr @set drop", or
+// "ip6 saddr @set drop" for an ipv6 set.
+func (s *NftSet) dropExprs(table *nftables.Table, set *nftables.Set) []expr.Any {
+	proto := byte(unix.NFPROTO_IPV4)
+	// Offset and length of the source address in the IP header.
+	offset, length := uint32(12), uint32(4)
+	if strings.ToLower(s.Type) == IPV6 {
+		proto = unix.NFPROTO_IPV6
+		offset, length = 8, 16
+	}
+	var exprs []expr.Any
+	// An inet table sees both families.
+	if table.Family == nftables.TableFamilyINet {
+		exprs = append(exprs,
+			&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+		)
+	}
+	return append(exprs,
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       offset,
+			Len:          length,
+		},
+		&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID},
+		&expr.Verdict{Kind: expr.VerdictDrop},
+	)
+}
+
+// Destroy removes what has been created for the set, if asked to tear it
+// down.
+func (s *NftSet) Destroy() error {
+	if !s.Teardown || s.created == nil {
+		return nil
+	}
+	s.created.Lock()
+	defer s.created.Unlock()
+	c := &nftables.Conn{}
+	switch {
+	case s.created.table != nil:
+		// Everything else goes with the table.
+		c.DelTable(s.created.table)
+	default:
+		if s.created.chain != nil {
+			c.FlushChain(s.created.chain)
+			c.DelChain(s.created.chain)
+		} else if s.created.rule != nil {
+			// The handle of the rule is only known by listing the rules.
+			rules, err := c.GetRule(s.created.rule.Table, s.created.rule.Chain)
+			if err != nil {
+				return err
+			}
+			for _, rule := range rules {
+				for _, e := range rule.Exprs {
+					if lookup, ok := e.(*expr.Lookup); ok && lookup.SetName == s.Name {
+						err = c.DelRule(rule)
+						if err != nil {
+							return err
+						}
+					}
+				}
+			}
+		}
+		if s.created.set != nil {
+			c.DelSet(s.created.set)
+		}
+	}
+	err := c.Flush()
+	s.created.table, s.created.set, s.created.chain, s.created.rule = nil, nil, nil, nil
+	return err
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// How a source follows its files: with the inotify events, falling back to
+// polling when the events do not come, or only polling them.
+const (
+	FOLLOW_INOTIFY = "inotify"
+	FOLLOW_POLL    = "poll"
+)
+
+// DEFAULT_POLL_INTERVAL is how often the files are polled, or checked for
+// changes without events, when no poll_interval is configured.
+const DEFAULT_POLL_INTERVAL = "5s"
+
+// MAX_MISSED is how many polls in a row must find changes without events
+// for a source to fall back to polling; a change right before a poll may
+// have its event not handled yet.
+const MAX_MISSED = 2
+
+// following returns the follow mode and the poll interval from the
+// configuration.
+func following(mode string, interval string) (string, time.Duration, error) {
+	mode = strings.ToLower(mode)
+	switch mode {
+	case "":
+		mode = FOLLOW_INOTIFY
+	case FOLLOW_INOTIFY, FOLLOW_POLL:
+	default:
+		return "", 0, fmt.Errorf("invalid follow %q; must be %s or %s", mode, FOLLOW_INOTIFY, FOLLOW_POLL)
+	}
+	if len(interval) == 0 {
+		interval = DEFAULT_POLL_INTERVAL
+	}
+	duration, err := parseDuration(interval)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid poll_interval %q: %w", interval, err)
+	}
+	if duration <= 0 {
+		return "", 0, fmt.Errorf("invalid poll_interval %q", interval)
+	}
+	return mode, duration, nil
+}
+
+// poll reads what is left in the rotated files, closing those done with,
+// and reads the files when polling; otherwise it checks that the changes to
+// them came with inotify events, and falls back to polling when they did not.
+func (source *Source) poll() error {
+	now := time.Now()
+	for _, f := range source.files() {
+		source.Blacklist(source.drain(f, now)...)
+	}
+	if !source.polling() {
+		if !source.missed() {
+			return nil
+		}
+		source.Lock()
+		source.Polling = true
+		source.Unlock()
+		source.Warningf(
+			"no inotify events for the changes to the files of %s; polling them every %s",
+			source.Name, source.PollInterval,
+		)
+	}
+	return source.resync()
+}
+
+// polling returns true if the source is polling its files.
+func (source *Source) polling() bool {
+	source.Lock()
+	defer source.Unlock()
+	return source.Polling
+}
+
+// missed returns true when the files have changed without events about
+// them since the last polls; the events about other files in the same
+// directories do not count.
+func (source *Source) missed() bool {
+	events := source.fileEvents
+	if events != source.lastEvents || !source.changed() {
+		source.missedPolls = 0
+	} else {
+		source.missedPolls++
+	}
+	source.lastEvents = events
+	return source.missedPolls >= MAX_MISSED
+}
+
+// changed returns true if a file has been written to since it was last
+// read, has been replaced or, waited for, has been created, or a new one
+// matches a glob.
+func (source *Source) changed() bool {
+	for _, pattern := range source.LogFiles {
+		if !isGlob(pattern) {
+			continue
+		}
+		paths, _ := filepath.Glob(pattern)
+		source.Lock()
+		found := true
+		for _, path := range paths {
+			if _, found = source.Files[path]; found {
+				continue
+			}
+			// Not followed, as it is a followed file moved.
+			if fileInfo, err := os.Stat(path); err == nil {
+				_, found = source.followedAs(fileInfo)
+			}
+			if !found {
+				break
+			}
+		}
+		source.Unlock()
+		if !found {
+			return true
+		}
+	}
+	for _, f := range source.files() {
+		source.Lock()
+		file, last := f.File, f.FileInfo
+		source.Unlock()
+		current, err := os.Stat(f.Path)
+		if err != nil {
+			continue
+		}
+		if last == nil || !os.SameFile(current, last) {
+			return true
+		}
+		// Still the file which could not be opened.
+		if file == nil {
+			continue
+		}
+		if current.Size() != last.Size() || !current.ModTime().Equal(last.ModTime()) {
+			return true
+		}
+	}
+	return false
+}
+
+// followMode describes how the source follows its files, for the stats.
+func (source *Source) followMode() string {
+	if source.Follow == FOLLOW_POLL {
+		return fmt.Sprintf("polling every %s", source.PollInterval)
+	}
+	if source.polling() {
+		return fmt.Sprintf("polling every %s (no inotify events)", source.PollInterval)
+	}
+	return FOLLOW_INOTIFY
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io/fs"
+	"log"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+// PRESETS_DIR is the directory of the embedded presets, one file for each,
+// named after the preset.
+const PRESETS_DIR = "presets"
+
+//go:embed presets/*.yaml
+var presets embed.FS
+
+// Preset is a named set of patterns for a common daemon, shipped with the
+// binary, with sample lines verifying them.
+type Preset struct {
+	Name        string            `yaml:"-"`
+	Description string            `yaml:"description"`
+	Definitions map[string]string `yaml:"definitions"`
+	Patterns    []PatternConfig   `yaml:"patterns"`
+	Examples    []ExampleConfig   `yaml:"examples"`
+}
+
+// LoadPreset returns the embedded preset with the given name.
+func LoadPreset(name string) (*Preset, error) {
+	data, err := presets.ReadFile(path.Join(PRESETS_DIR, name+".yaml"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("unknown preset %q", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	preset := &Preset{Name: name}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err = decoder.Decode(preset)
+	if err == nil {
+		err = strictPatterns(data, nil)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("preset %s: %w", name, err)
+	}
+	return preset, nil
+}
+
+// PresetNames returns the names of the embedded presets, sorted.
+func PresetNames() []string {
+	var names []string
+	entries, _ := presets.ReadDir(PRESETS_DIR)
+	for _, entry := range entries {
+		if name, found := strings.CutSuffix(entry.Name(), ".yaml"); found {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Verify compiles the patterns of the preset and runs them over its
+// examples.
+func (p *Preset) Verify() []error {
+	source := exampleSource(p.Name)
+	config := &SourceConfig{Name: p.Name, Patterns: p.Patterns, Definitions: p.Definitions}
+	patterns, err := source.compilePatterns(config)
+	if err != nil {
+		return []error{err}
+	}
+	if len(patterns) != len(p.Patterns) {
+		return []error{errors.New("invalid patterns")}
+	}
+	return verifyExamples(p.Name, patterns, nil, p.Examples)
+}
+
+// sourcePatterns returns the patterns of the source, the ones of its preset
+// first, with the definitions they use; those of the source take
+// precedence over those of the preset.
+func sourcePatterns(config *SourceConfig) ([]PatternConfig, map[string]string, error) {
+	if len(config.Preset) == 0 {
+		return config.Patterns, config.Definitions, nil
+	}
+	preset, err := LoadPreset(config.Preset)
+	if err != nil {
+		return nil, nil, err
+	}
+	definitions := maps.Clone(preset.Definitions)
+	if definitions == nil {
+		definitions = make(map[string]string)
+	}
+	maps.Copy(definitions, config.Definitions)
+	patterns := append(slices.Clone(preset.Patterns), config.Patterns...)
+	return patterns, definitions, nil
+}
+
+// listPresets prints the embedded presets, or the details of the given
+// ones, each verified against its examples. It returns the exit code of the
+// command.
+func listPresets(args []string) int {
+	flags := flag.NewFlagSet("presets", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s presets [name...]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+	log.SetFlags(0)
+	names := flags.Args()
+	details := len(names) > 0
+	if !details {
+		names = PresetNames()
+	}
+	code := 0
+	for _, name := range names {
+		preset, err := LoadPreset(name)
+		if err != nil {
+			log.Print(err)
+			code = 1
+			continue
+		}
+		errs := preset.Verify()
+		status := "ok"
+		if len(errs) > 0 {
+			status = "FAILED"
+			code = 1
+		}
+		fmt.Printf("%-10s %s (%d patterns, %d examples: %s)\n",
+			preset.Name, preset.Description, len(preset.Patterns), len(preset.Examples), status,
+		)
+		for _, err := range errs {
+			fmt.Printf("  %s\n", err.Error())
+		}
+		if !details {
+			continue
+		}
+		for _, name := range slices.Sorted(maps.Keys(preset.Definitions)) {
+			fmt.Printf("  <%s> %s\n", name, preset.Definitions[name])
+		}
+		for _, pattern := range preset.Patterns {
+			fmt.Printf("  - %s\n", pattern.Regexp)
+		}
+	}
+	return code
+}
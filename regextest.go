@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// patternFlags are the patterns given on the command line.
+type patternFlags []string
+
+func (p *patternFlags) String() string {
+	return strings.Join(*p, ", ")
+}
+
+func (p *patternFlags) Set(value string) error {
+	*p = append(*p, value)
+	return nil
+}
+
+// patternResult is what a pattern matched in the sample log.
+type patternResult struct {
+	pattern   *Pattern
+	lines     int
+	addresses []string
+	counts    map[string]int
+}
+
+// lineResult is a line of the sample log, with the text captured from it
+// which is not an address, if any.
+type lineResult struct {
+	number  int
+	text    string
+	capture string
+	pattern string
+}
+
+// testPatterns runs the patterns of a source, or the given ones, over a
+// sample log (standard input by default) the same way the source would,
+// and prints what they matched, like fail2ban-regex.
+// It returns the exit code of the command.
+func testPatterns(args []string) int {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	var fileConfig, name, preset, level string
+	var patterns patternFlags
+	flags.StringVar(&fileConfig, "config", "", "Configuration file")
+	flags.StringVar(&name, "source", "", "Source whose patterns and whitelist are tested (default the first one)")
+	flags.Var(&patterns, "pattern", "Pattern to test instead of the ones of the source; can be repeated")
+	flags.StringVar(&preset, "preset", "", "Preset to test instead of the patterns of the source")
+	flags.StringVar(&level, "level", "err", "Minimum severity of the messages logged while parsing (debug shows the whitelisted addresses)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s test [options] [file]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if flags.NArg() > 1 {
+		flags.Usage()
+		return 2
+	}
+	log.SetFlags(0)
+
+	sourceConfig := &SourceConfig{Name: "test", Backend: BACKEND_MEMORY}
+	var global *Whitelist
+	// Ad-hoc patterns only need the configuration for the whitelist, if given.
+	if (len(patterns) == 0 && len(preset) == 0) || len(fileConfig) > 0 {
+		if len(fileConfig) == 0 {
+			fileConfig = defaultConfig()
+		}
+		config, err := loadConfig(fileConfig, false)
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+		sourceConfig, err = findSource(config, name)
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+		var errs []error
+		global, errs = NewWhitelist(config.Whitelist, config.WhitelistFiles, log.Printf)
+		for _, err := range errs {
+			log.Printf("%s in global whitelist", err.Error())
+		}
+	}
+	if len(patterns) > 0 || len(preset) > 0 {
+		sourceConfig.Preset = preset
+		sourceConfig.Patterns = nil
+		for _, pattern := range patterns {
+			sourceConfig.Patterns = append(sourceConfig.Patterns, PatternConfig{Regexp: pattern})
+		}
+	}
+
+	source := &Source{Name: sourceConfig.Name, LogLevel: severity(level)}
+	source.Blockers, err = newBlockers(sourceConfig)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	if sourceConfig.IPv6PrefixLength > 0 && sourceConfig.IPv6PrefixLength < 128 {
+		source.IPv6PrefixLength = sourceConfig.IPv6PrefixLength
+	}
+	source.IgnorePatterns, err = compileIgnorePatterns(sourceConfig)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	// Sample logs are usually old, so the age of the lines is not checked;
+	// only that they have a timestamp.
+	source.Timestamp, _, err = newTimestamp(sourceConfig)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	source.Patterns, err = source.compilePatterns(sourceConfig)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	if len(source.Patterns) == 0 {
+		return 1
+	}
+	whitelist, errs := NewWhitelist(sourceConfig.Whitelist, sourceConfig.WhitelistFiles, source.Warningf)
+	for _, err := range errs {
+		source.Warningf("%s in source %q", err.Error(), source.Name)
+	}
+	whitelist.Parent = global
+	source.WhiteList = whitelist
+	if sourceConfig.ProtectLocal {
+		source.Local = &LocalAddresses{}
+		if err := source.Local.Refresh(); err != nil {
+			source.Warningf("could not collect all local addresses: %s", err.Error())
+		}
+	}
+
+	input := io.Reader(os.Stdin)
+	if flags.NArg() == 1 && flags.Arg(0) != "-" {
+		file, err := os.Open(flags.Arg(0))
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+		defer file.Close()
+		input = file
+	}
+
+	results := make([]*patternResult, len(source.Patterns))
+	for i, p := range source.Patterns {
+		results[i] = &patternResult{pattern: p, counts: make(map[string]int)}
+	}
+	var missed, invalid, vetoed, untimed []lineResult
+	total := 0
+	now := time.Now()
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		total++
+		line := scanner.Text()
+		if r := source.ignored(line); r != nil {
+			vetoed = append(vetoed, lineResult{number: total, text: line, pattern: r.String()})
+			continue
+		}
+		if source.Timestamp != nil {
+			if _, found := source.Timestamp.Parse(line, now); !found {
+				untimed = append(untimed, lineResult{number: total, text: line})
+			}
+		}
+		matched := false
+		for _, result := range results {
+			r := result.pattern.Regexp
+			if !r.MatchString(line) {
+				continue
+			}
+			matched = true
+			result.lines++
+			matches, captures := source.parse(line, result.pattern)
+			for _, match := range matches {
+				address := match.Address.String()
+				if result.counts[address] == 0 {
+					result.addresses = append(result.addresses, address)
+				}
+				result.counts[address]++
+			}
+			for _, capture := range captures {
+				invalid = append(invalid, lineResult{number: total, text: line, capture: capture, pattern: r.String()})
+			}
+		}
+		if !matched {
+			missed = append(missed, lineResult{number: total, text: line})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Print(err)
+		return 1
+	}
+
+	fmt.Printf("Lines: %d, matched: %d, ignored: %d, missed: %d\n",
+		total, total-len(missed)-len(vetoed), len(vetoed), len(missed),
+	)
+	fmt.Println()
+	fmt.Println("Patterns:")
+	for i, result := range results {
+		fmt.Printf("%d) %s\n", i+1, result.pattern.Regexp.String())
+		fmt.Printf("   matched lines: %d, addresses: %d\n", result.lines, len(result.addresses))
+		for _, address := range result.addresses {
+			fmt.Printf("   %s: %d\n", address, result.counts[address])
+		}
+	}
+	if len(invalid) > 0 {
+		fmt.Println()
+		fmt.Println("Invalid captured addresses:")
+		for _, l := range invalid {
+			fmt.Printf("line %d: %q captured by %s in %q\n", l.number, l.capture, l.pattern, l.text)
+		}
+	}
+	if len(vetoed) > 0 {
+		fmt.Println()
+		fmt.Println("Ignored lines:")
+		for _, l := range vetoed {
+			fmt.Printf("line %d: %s (ignored by %s)\n", l.number, l.text, l.pattern)
+		}
+	}
+	if len(untimed) > 0 {
+		fmt.Println()
+		fmt.Println("Lines without timestamp:")
+		for _, l := range untimed {
+			fmt.Printf("line %d: %s\n", l.number, l.text)
+		}
+	}
+	if len(missed) > 0 {
+		fmt.Println()
+		fmt.Println("Missed lines:")
+		for _, l := range missed {
+			fmt.Printf("line %d: %s\n", l.number, l.text)
+		}
+	}
+	return 0
+}
+
+// findSource returns the configuration of the source with the given name, or
+// of the first source if no name is given.
+func findSource(config *Config, name string) (*SourceConfig, error) {
+	if len(config.Sources) == 0 {
+		return nil, errors.New("no sources in configuration")
+	}
+	if len(name) == 0 {
+		return config.Sources[0], nil
+	}
+	for _, sourceConfig := range config.Sources {
+		if sourceConfig.Name == name {
+			return sourceConfig, nil
+		}
+	}
+	return nil, fmt.Errorf("no source %q in configuration", name)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"compress/bzip2"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// FINGERPRINT_SIZE is how many bytes from the start of a log file tell it
+// apart from the others, once rotated and compressed.
+const FINGERPRINT_SIZE = 256
+
+// rotatedSuffix matches what is appended to the name of a rotated log file:
+// a number or a date, and the extension of its compression, if any.
+var rotatedSuffix = regexp.MustCompile(`^[-._][0-9]+(?:[-._][0-9]+)*(\.gz|\.zst|\.bz2)?$`)
+
+// rotatedFile is a rotated log file, possibly compressed.
+type rotatedFile struct {
+	Path       string
+	FileInfo   os.FileInfo
+	Compressed bool
+}
+
+// Open returns the content of the rotated file, decompressed.
+func (r rotatedFile) Open() (io.ReadCloser, error) {
+	file, err := os.Open(r.Path)
+	if err != nil {
+		return nil, err
+	}
+	switch filepath.Ext(r.Path) {
+	case ".gz":
+		reader, err := gzip.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("%s: %w", r.Path, err)
+		}
+		return readCloser{reader, file}, nil
+	case ".zst":
+		reader, err := zstd.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("%s: %w", r.Path, err)
+		}
+		return readCloser{reader.IOReadCloser(), file}, nil
+	case ".bz2":
+		return readCloser{bzip2.NewReader(file), file}, nil
+	}
+	return file, nil
+}
+
+// readCloser reads from a decompressing reader and closes the file below it.
+type readCloser struct {
+	io.Reader
+	file *os.File
+}
+
+func (r readCloser) Close() error {
+	if closer, ok := r.Reader.(io.Closer); ok {
+		closer.Close()
+	}
+	return r.file.Close()
+}
+
+// rotatedFiles returns the rotated files of the log file in its directory,
+// oldest first.
+func rotatedFiles(path string) ([]rotatedFile, error) {
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	base := filepath.Base(path)
+	var files []rotatedFile
+	for _, entry := range entries {
+		suffix, found := strings.CutPrefix(entry.Name(), base)
+		if !found || !entry.Type().IsRegular() {
+			continue
+		}
+		m := rotatedSuffix.FindStringSubmatch(suffix)
+		if m == nil {
+			continue
+		}
+		fileInfo, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, rotatedFile{
+			Path:       filepath.Join(filepath.Dir(path), entry.Name()),
+			FileInfo:   fileInfo,
+			Compressed: len(m[1]) > 0,
+		})
+	}
+	slices.SortFunc(files, func(a, b rotatedFile) int {
+		return a.FileInfo.ModTime().Compare(b.FileInfo.ModTime())
+	})
+	return files, nil
+}
+
+// fingerprint returns the hash of the first size bytes of the content, or
+// an empty string if it is shorter.
+func fingerprint(r io.Reader, size int) string {
+	head := make([]byte, size)
+	_, err := io.ReadFull(r, head)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(head)
+	return hex.EncodeToString(sum[:])
+}
+
+// fingerprint updates the fingerprint of the log file, until it is long
+// enough. The caller must hold the lock.
+func (f *LogFile) fingerprint() {
+	if f.File == nil || f.FingerprintSize >= FINGERPRINT_SIZE {
+		return
+	}
+	size := int(min(f.FileInfo.Size(), FINGERPRINT_SIZE))
+	if size <= f.FingerprintSize {
+		return
+	}
+	f.Fingerprint = fingerprint(io.NewSectionReader(f.File, 0, int64(size)), size)
+	f.FingerprintSize = size
+}
+
+// same returns true if the log file starts like the one of the position,
+// which may have been truncated and written again since.
+func (f *LogFile) same(position Position) bool {
+	if position.FingerprintSize == 0 {
+		return true
+	}
+	head := io.NewSectionReader(f.File, 0, int64(position.FingerprintSize))
+	return fingerprint(head, position.FingerprintSize) == position.Fingerprint
+}
+
+// predecessor returns the rotated file the saved position is in, found by
+// its inode or, when compressed, by its fingerprint.
+func predecessor(position Position, rotated []rotatedFile) (int, bool) {
+	for i, r := range rotated {
+		if r.Compressed {
+			continue
+		}
+		device, inode := fileID(r.FileInfo)
+		if device == position.Device && inode == position.Inode {
+			return i, true
+		}
+	}
+	// A fingerprint which could not be read would match any short file.
+	if position.FingerprintSize == 0 || len(position.Fingerprint) == 0 {
+		return 0, false
+	}
+	for i, r := range rotated {
+		content, err := r.Open()
+		if err != nil {
+			continue
+		}
+		found := fingerprint(content, position.FingerprintSize) == position.Fingerprint
+		content.Close()
+		if found {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// catchUp reads what was written to the log file, after the saved position,
+// before it was rotated while not watched: the rest of the rotated file the
+// position is in and the files rotated after it. It returns false if there
+// is no such file. The caller must hold the lock.
+func (source *Source) catchUp(f *LogFile, position Position, blacklist *Blacklist) bool {
+	rotated, err := rotatedFiles(f.Path)
+	if err != nil {
+		source.Warningf("could not look for rotated files of %s: %s", f.Path, err.Error())
+		return false
+	}
+	// Not the file being read, after a copytruncate.
+	rotated = slices.DeleteFunc(rotated, func(r rotatedFile) bool {
+		return f.FileInfo != nil && os.SameFile(r.FileInfo, f.FileInfo)
+	})
+	i, found := predecessor(position, rotated)
+	if !found {
+		return false
+	}
+	for j, r := range rotated[i:] {
+		skip := uint64(0)
+		if j == 0 {
+			skip = position.Pos
+		}
+		source.Infof("catching up %s with %s from byte %d", f.Path, r.Path, skip)
+		err := source.readRotated(r, skip, blacklist)
+		if err != nil {
+			source.Warningf("could not catch up %s with %s: %s", f.Path, r.Path, err.Error())
+		}
+	}
+	return true
+}
+
+// readRotated reads the rotated file from the given position. The caller
+// must hold the lock.
+func (source *Source) readRotated(r rotatedFile, skip uint64, blacklist *Blacklist) error {
+	content, err := r.Open()
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	_, err = io.CopyN(io.Discard, content, int64(skip))
+	if err != nil {
+		return err
+	}
+	source.Stats.BytesRead += source.readLines(content, blacklist)
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"github.com/klauspost/compress/zstd"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// bzip2Content is "bz2 rotated line 1\nbz2 rotated line 2\n" compressed, as
+// the standard library cannot write bzip2.
+const bzip2Content = "QlpoOTFBWSZTWR6vHPcAAAdZgAAQQAAwADYllBAgACCqpp6GoPU9QpgACIlKGlrS2pCm1LcrfLfi7kinChID1eOe4A=="
+
+func TestRotatedSuffix(t *testing.T) {
+	tests := []struct {
+		suffix     string
+		rotated    bool
+		compressed bool
+	}{
+		{".1", true, false},
+		{".12", true, false},
+		{"-20240101", true, false},
+		{"-2024-01-01", true, false},
+		{"_1", true, false},
+		{".1.gz", true, true},
+		{"-20240101.zst", true, true},
+		{".2.bz2", true, true},
+		{"", false, false},
+		{".gz", false, false},
+		{".old", false, false},
+		{".1.xz", false, false},
+		{".1.gz.tmp", false, false},
+		{"1", false, false},
+		{".err", false, false},
+	}
+	for _, test := range tests {
+		m := rotatedSuffix.FindStringSubmatch(test.suffix)
+		if (m != nil) != test.rotated {
+			t.Errorf("suffix %q: rotated %t, want %t", test.suffix, m != nil, test.rotated)
+			continue
+		}
+		if m != nil && (len(m[1]) > 0) != test.compressed {
+			t.Errorf("suffix %q: compressed %t, want %t", test.suffix, len(m[1]) > 0, test.compressed)
+		}
+	}
+}
+
+func TestPredecessor(t *testing.T) {
+	dir := t.TempDir()
+	contents := map[string]string{
+		"app.log.1":     "plain rotated line 1\nplain rotated line 2\n",
+		"app.log.2.gz":  "gzip rotated line 1\ngzip rotated line 2\n",
+		"app.log.3.zst": "zstd rotated line 1\nzstd rotated line 2\n",
+		"app.log.4.bz2": "bz2 rotated line 1\nbz2 rotated line 2\n",
+	}
+	writeRotated(t, dir, contents)
+	var rotated []rotatedFile
+	for _, name := range []string{"app.log.1", "app.log.2.gz", "app.log.3.zst", "app.log.4.bz2"} {
+		path := filepath.Join(dir, name)
+		fileInfo, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rotated = append(rotated, rotatedFile{
+			Path:       path,
+			FileInfo:   fileInfo,
+			Compressed: filepath.Ext(name) != ".1",
+		})
+	}
+	position := func(name string, size int) Position {
+		p := Position{File: filepath.Join(dir, "app.log"), Pos: 10}
+		if size > 0 {
+			p.Fingerprint = fingerprint(strings.NewReader(contents[name]), size)
+			p.FingerprintSize = size
+		}
+		return p
+	}
+	withID := func(p Position, name string) Position {
+		fileInfo, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Device, p.Inode = fileID(fileInfo)
+		return p
+	}
+	tests := []struct {
+		name     string
+		position Position
+		index    int
+		found    bool
+	}{
+		{"inode of an uncompressed file", withID(position("", 0), "app.log.1"), 0, true},
+		{"fingerprint of a gzip file", position("app.log.2.gz", 16), 1, true},
+		{"fingerprint of a zstd file", position("app.log.3.zst", 16), 2, true},
+		{"fingerprint of a bzip2 file", position("app.log.4.bz2", 16), 3, true},
+		{"whole content as fingerprint", position("app.log.3.zst", len(contents["app.log.3.zst"])), 2, true},
+		{"fingerprint of a copied uncompressed file", position("app.log.1", 16), 0, true},
+		{"inode before fingerprint", withID(position("app.log.2.gz", 16), "app.log.1"), 0, true},
+		{"inode of a compressed file", withID(position("", 0), "app.log.2.gz"), 0, false},
+		{"fingerprint longer than the content", Position{
+			Fingerprint:     fingerprint(strings.NewReader(contents["app.log.2.gz"]+strings.Repeat("x", FINGERPRINT_SIZE)), FINGERPRINT_SIZE),
+			FingerprintSize: FINGERPRINT_SIZE,
+		}, 0, false},
+		{"empty fingerprint", Position{FingerprintSize: FINGERPRINT_SIZE}, 0, false},
+		{"unknown fingerprint", Position{Fingerprint: "0123", FingerprintSize: 16}, 0, false},
+		{"no inode nor fingerprint", position("", 0), 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			i, found := predecessor(test.position, rotated)
+			if found != test.found || (found && i != test.index) {
+				t.Errorf("predecessor = %d, %t; want %d, %t", i, found, test.index, test.found)
+			}
+		})
+	}
+}
+
+// writeRotated writes the rotated files in the directory, compressed as
+// their extension says.
+func writeRotated(t *testing.T, dir string, contents map[string]string) {
+	t.Helper()
+	for name, content := range contents {
+		var data []byte
+		switch filepath.Ext(name) {
+		case ".gz":
+			var b bytes.Buffer
+			w := gzip.NewWriter(&b)
+			w.Write([]byte(content))
+			w.Close()
+			data = b.Bytes()
+		case ".zst":
+			w, err := zstd.NewWriter(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data = w.EncodeAll([]byte(content), nil)
+			w.Close()
+		case ".bz2":
+			var err error
+			data, err = base64.StdEncoding.DecodeString(bzip2Content)
+			if err != nil {
+				t.Fatal(err)
+			}
+		default:
+			data = []byte(content)
+		}
+		err := os.WriteFile(filepath.Join(dir, name), data, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
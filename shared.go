@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"slices"
+	"sync"
+)
+
+// sharedFile is a log file opened once for all the sources following it:
+// what is written to it is read once, by the first source reading it, and
+// kept until every source has had it.
+type sharedFile struct {
+	sync.Mutex
+	device, inode uint64
+	File          *os.File
+	// FileInfo is of the file when it was last read.
+	FileInfo os.FileInfo
+	// data are the bytes of the file from start on, read but not yet
+	// had by every source.
+	start uint64
+	data  []byte
+	// readers are the sources reading the file, with where they were at
+	// their last read; nil until they read it.
+	readers map[*Source]*filePosition
+}
+
+// filePosition is where a source is in a shared file; truncated is true
+// when the file was truncated since, so the source starts again from its
+// beginning.
+type filePosition struct {
+	pos       uint64
+	truncated bool
+}
+
+// Read returns what was written to the file from the position of the
+// source on, with the position it starts from, which is zero when the file
+// was truncated, and the file info it goes up to. What was already read for
+// another source is not read again.
+func (s *sharedFile) Read(source *Source, pos uint64) ([]byte, uint64, os.FileInfo, error) {
+	s.Lock()
+	defer s.Unlock()
+	if r := s.readers[source]; r != nil && r.truncated {
+		pos = 0
+	}
+	fileInfo, err := s.File.Stat()
+	if err != nil {
+		return nil, pos, s.FileInfo, err
+	}
+	s.FileInfo = fileInfo
+	size := uint64(fileInfo.Size())
+	end := s.start + uint64(len(s.data))
+	// Truncated in place, like with copytruncate.
+	if size < end || size < pos {
+		s.start, s.data, end, pos = 0, nil, 0, 0
+		for other, r := range s.readers {
+			if r != nil && other != source {
+				r.pos, r.truncated = 0, true
+			}
+		}
+	}
+	// No source needs what is between the bytes kept and the lowest
+	// position, as with start_at end.
+	lowest := pos
+	for other, r := range s.readers {
+		if r != nil && other != source && r.pos < lowest {
+			lowest = r.pos
+		}
+	}
+	if lowest > end {
+		s.start, s.data, end = lowest, nil, lowest
+	}
+	// A source behind the others, as when it has just started.
+	if pos < s.start {
+		head := make([]byte, s.start-pos)
+		n, err := s.File.ReadAt(head, int64(pos))
+		if n < len(head) {
+			return nil, pos, s.FileInfo, err
+		}
+		s.data = append(head, s.data...)
+		s.start = pos
+	}
+	if size > end {
+		tail := make([]byte, size-end)
+		n, err := s.File.ReadAt(tail, int64(end))
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, pos, s.FileInfo, err
+		}
+		s.data = append(s.data, tail[:n]...)
+	}
+	s.readers[source] = &filePosition{pos: pos}
+	s.trim()
+	return s.data[pos-s.start:], pos, s.FileInfo, nil
+}
+
+// trim drops the bytes every source has had; the caller must hold the lock.
+func (s *sharedFile) trim() {
+	lowest := s.start + uint64(len(s.data))
+	for _, r := range s.readers {
+		if r != nil && r.pos < lowest {
+			lowest = r.pos
+		}
+	}
+	if lowest <= s.start {
+		return
+	}
+	// Copied, so that the bytes dropped are freed.
+	s.data = slices.Clone(s.data[lowest-s.start:])
+	s.start = lowest
+}
+
+// OpenFile returns the file at the path for the source, opened once for all
+// the sources reading it.
+func (w *Watcher) OpenFile(source *Source, path string) (*sharedFile, error) {
+	w.Lock()
+	defer w.Unlock()
+	if fileInfo, err := os.Stat(path); err == nil {
+		device, inode := fileID(fileInfo)
+		if s, found := w.files[[2]uint64{device, inode}]; found {
+			s.add(source)
+			return s, nil
+		}
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	device, inode := fileID(fileInfo)
+	// Replaced since, by a file already open.
+	if s, found := w.files[[2]uint64{device, inode}]; found {
+		file.Close()
+		s.add(source)
+		return s, nil
+	}
+	s := &sharedFile{
+		device:   device,
+		inode:    inode,
+		File:     file,
+		FileInfo: fileInfo,
+		readers:  map[*Source]*filePosition{source: nil},
+	}
+	w.files[[2]uint64{device, inode}] = s
+	return s, nil
+}
+
+// ReleaseFile closes the file once no source reads it anymore.
+func (w *Watcher) ReleaseFile(source *Source, s *sharedFile) {
+	w.Lock()
+	defer w.Unlock()
+	s.Lock()
+	delete(s.readers, source)
+	s.trim()
+	left := len(s.readers)
+	s.Unlock()
+	if left > 0 {
+		return
+	}
+	key := [2]uint64{s.device, s.inode}
+	if w.files[key] == s {
+		delete(w.files, key)
+	}
+	s.File.Close()
+}
+
+// add counts the source among the readers of the file.
+func (s *sharedFile) add(source *Source) {
+	s.Lock()
+	defer s.Unlock()
+	if _, found := s.readers[source]; !found {
+		s.readers[source] = nil
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSharedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	err := os.WriteFile(path, []byte("line 1\nline 2\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	watcher, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.stop()
+	first, second := &Source{Name: "first"}, &Source{Name: "second"}
+	a, err := watcher.OpenFile(first, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := watcher.OpenFile(second, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != b {
+		t.Fatal("the file is opened once per source")
+	}
+	read := func(source *Source, pos uint64, want string, wantPos uint64) {
+		t.Helper()
+		data, from, _, err := a.Read(source, pos)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want || from != wantPos {
+			t.Errorf("%s read %q from %d, want %q from %d", source.Name, data, from, want, wantPos)
+		}
+	}
+	read(first, 0, "line 1\nline 2\n", 0)
+	// Read once: what is written over it since is not seen.
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	file.WriteAt([]byte("LINE"), 0)
+	read(second, 0, "line 1\nline 2\n", 0)
+	// Dropped once both have had it.
+	read(first, 14, "", 14)
+	read(second, 7, "line 2\n", 7)
+	if a.start != 7 {
+		t.Errorf("kept from %d, want 7", a.start)
+	}
+	file.WriteAt([]byte("line 3\n"), 14)
+	read(second, 14, "line 3\n", 14)
+	read(first, 14, "line 3\n", 14)
+	// Truncated in place: both start again from the beginning.
+	file.Truncate(0)
+	file.WriteAt([]byte("new\n"), 0)
+	read(first, 21, "new\n", 0)
+	read(second, 21, "new\n", 0)
+	// Closed with the last source.
+	watcher.ReleaseFile(first, a)
+	watcher.ReleaseFile(second, a)
+	if len(watcher.files) != 0 {
+		t.Errorf("%d files still open", len(watcher.files))
+	}
+	if _, err := a.File.Stat(); err == nil {
+		t.Error("file not closed")
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"golang.org/x/sys/unix"
@@ -11,37 +12,84 @@ import (
 	"net"
 	"os"
 	"path"
+	"path/filepath"
 	"regexp"
 	"slices"
 	"strings"
 	"sync"
 	"time"
-	"unsafe"
 )
 
 // Source is the struct defining the log source to watch.
 type Source struct {
 	sync.Mutex
-	Name            string
-	Set             NftSet
-	LogFile         string
-	Regexps         []*regexp.Regexp
-	Events          chan uint32
-	Logger          *syslog.Writer
-	Pos             uint64
-	FileInfo        os.FileInfo
-	FileDescriptor  int
-	WatchDescriptor int
-	LogLevel        syslog.Priority
-	Config          *SourceConfig
-	Stats           Stats
-	WhiteList       []net.IP
+	Name     string
+	Blockers Blockers
+	// BanTime is how long addresses are banned for; zero is forever.
+	BanTime time.Duration
+	// Observe is true when the source only logs what it would ban.
+	Observe bool
+	// LogFiles are the paths, or globs, of the files followed.
+	LogFiles []string
+	// Files are the files followed, by path.
+	Files    map[string]*LogFile
+	Patterns []*Pattern
+	// IgnorePatterns veto the lines matching them.
+	IgnorePatterns []*regexp.Regexp
+	// Timestamp extracts the time of the lines; without it a line happened
+	// when read.
+	Timestamp *Timestamp
+	// MaxAge is how old a line may be and still count; zero for any age.
+	MaxAge      time.Duration
+	Counter     *Counter
+	Escalation  *Escalation
+	Offences    *Offences
+	Aggregation *Aggregation
+	// IPv6PrefixLength is the length of the networks IPv6 addresses are
+	// banned with; zero to ban single addresses.
+	IPv6PrefixLength int
+	// Events are the inotify events about the files, from the Watcher.
+	Events  <-chan inotifyEvent
+	Watcher *Watcher
+	// Follow is how the files are followed, FOLLOW_INOTIFY or FOLLOW_POLL;
+	// Polling is true when polling them, also after falling back to it.
+	Follow       string
+	PollInterval time.Duration
+	Polling      bool
+	// fileEvents counts the events about the files followed, for telling
+	// when they change without events.
+	fileEvents  int
+	lastEvents  int
+	missedPolls int
+	Logger      *syslog.Writer
+	StartAt     string
+	StateFile   string
+	// Directories are the directories of the files, by watch descriptor.
+	Directories map[int]string
+	LogLevel    syslog.Priority
+	Config      *SourceConfig
+	Stats       Stats
+	WhiteList   *Whitelist
+	Local       *LocalAddresses
+}
+
+// Pattern is a compiled regular expression with the counter deciding when
+// its matches are enough for blacklisting an address.
+// The address is in the groups named ADDRESS_GROUP, if any, or else in the
+// unnamed groups; the other named groups are fields of the match.
+type Pattern struct {
+	Regexp  *regexp.Regexp
+	Counter *Counter
+	// Conditions on the named groups must all pass for a match to count.
+	Conditions []*Condition
+	// Examples are the sample lines the pattern alone must match.
+	Examples []ExampleConfig
 }
 
 // Init initialise the source according to the configuration entry.
 func Init(config *SourceConfig) (source *Source, err error) {
 	source = &Source{}
-	source.LogFile = config.LogFile
+	source.LogFiles = logFiles(config)
 	source.Name = config.Name
 	source.Lock()
 	defer source.Unlock()
@@ -67,256 +115,553 @@ func Init(config *SourceConfig) (source *Source, err error) {
 	source.Logger = logger
 	source.LogLevel = severity(config.Syslog.LogLevel)
 
-	if len(config.Set.Name) > 0 {
-		err = config.Set.Check()
+	blockers, err := newBlockers(config)
+	if err != nil {
+		return source, err
+	}
+	var timeout time.Duration
+	if len(config.BanTime) > 0 {
+		timeout, err = parseDuration(config.BanTime)
 		if err != nil {
-			return source, fmt.Errorf("invalid nft set @%s: %w", config.Set.Name, err)
+			return source, fmt.Errorf("invalid ban_time %q: %w", config.BanTime, err)
 		}
-		source.Set = config.Set
-	} else {
-		return source, errors.New("missing nft set name")
 	}
+	if config.Escalation != nil {
+		source.Escalation, err = NewEscalation(config.Escalation, timeout)
+		if err != nil {
+			return source, fmt.Errorf("invalid escalation: %w", err)
+		}
+		// The first ban decides whether the set needs the timeout flag.
+		timeout = source.Escalation.Duration(1)
+	}
+	source.BanTime = timeout
+	source.Observe, err = observing(config.Mode)
+	if err != nil {
+		return source, err
+	}
+	if config.IPv6PrefixLength < 0 || config.IPv6PrefixLength > 128 {
+		return source, fmt.Errorf("invalid ipv6_prefix_length %d", config.IPv6PrefixLength)
+	}
+	// A /128 is a single address anyway.
+	if config.IPv6PrefixLength < 128 {
+		source.IPv6PrefixLength = config.IPv6PrefixLength
+	}
+	for _, blocker := range blockers {
+		// IPv6 networks need a blocker taking networks.
+		networks := source.IPv6PrefixLength > 0 && blocker.Family() != IPV4
+		blocker.Require(timeout > 0, networks)
+	}
+	source.Blockers = blockers
 
-	_, err = os.Stat(config.LogFile)
+	if config.Aggregate != nil {
+		// Without blockers of its own, it requires networks from the ones
+		// of the source.
+		source.Aggregation, err = NewAggregation(config.Aggregate, source.Blockers, timeout)
+		if err != nil {
+			return source, fmt.Errorf("invalid aggregate: %w", err)
+		}
+	}
+	// Observing leaves the blockers alone, they may not even exist yet.
+	if !source.Observe {
+		err = source.Blockers.Check()
+		if err != nil {
+			return source, err
+		}
+		if source.Aggregation != nil && !source.Aggregation.Shared {
+			err = source.Aggregation.Blockers.Check()
+			if err != nil {
+				return source, fmt.Errorf("invalid aggregate: %w", err)
+			}
+		}
+	}
+
+	// A missing log file is waited for, but not a missing directory.
+	errs := checkLogFiles(source.LogFiles)
+	if len(errs) > 0 {
+		return source, errors.Join(errs...)
+	}
+
+	source.StartAt, err = startAt(config.StartAt)
 	if err != nil {
-		return
+		return source, err
+	}
+
+	source.Follow, source.PollInterval, err = following(config.Follow, config.PollInterval)
+	if err != nil {
+		return source, err
+	}
+	source.Polling = source.Follow == FOLLOW_POLL
+
+	source.Timestamp, source.MaxAge, err = newTimestamp(config)
+	if err != nil {
+		return source, err
+	}
+
+	source.Counter, err = newCounter(config.MaxMatches, config.FindWindow)
+	if err != nil {
+		return source, fmt.Errorf("invalid threshold for source %s: %w", source.Name, err)
 	}
 
-	var regexps []*regexp.Regexp
-	for _, pattern := range config.Patterns {
-		r, err := regexp.Compile(pattern)
+	source.Patterns, err = source.compilePatterns(config)
+	if err != nil {
+		return source, err
+	}
+	source.IgnorePatterns, err = compileIgnorePatterns(config)
+	if err != nil {
+		return source, err
+	}
+	// A broken pattern would silently stop blacklisting.
+	errs = verifyExamples(source.Name, source.Patterns, source.IgnorePatterns, config.Examples)
+	if len(errs) > 0 {
+		return source, fmt.Errorf("failed examples: %w", errors.Join(errs...))
+	}
+
+	whitelist, errs := NewWhitelist(config.Whitelist, config.WhitelistFiles, source.Warningf)
+	for _, err := range errs {
+		source.Warningf("%s in source %q", err.Error(), source.Name)
+	}
+	source.WhiteList = whitelist
+
+	source.Config = config
+	if len(config.StatsInterval) > 0 {
+		interval, err := time.ParseDuration(config.StatsInterval)
+		if err != nil {
+			source.Warning(err.Error())
+		}
+		if interval > 0 {
+			source.Stats.Interval = interval
+		}
+	}
+	return
+}
+
+// compilePatterns compiles the patterns of the source, and of its preset,
+// each with its counter; the invalid ones are logged and skipped.
+func (source *Source) compilePatterns(config *SourceConfig) ([]*Pattern, error) {
+	var patterns []*Pattern
+	configs, definitions, err := sourcePatterns(config)
+	if err != nil {
+		return patterns, err
+	}
+	for _, pattern := range configs {
+		expanded, err := expand(pattern.Regexp, definitions)
+		if err != nil {
+			source.Warningf(
+				"failed to expand pattern %s for source %s with error: %s",
+				pattern.Regexp, source.Name, err.Error(),
+			)
+			continue
+		}
+		r, err := regexp.Compile(expanded)
 		if err != nil {
 			source.Warning(
 				fmt.Sprintf(
 					"failed to compile pattern %s for source %s with error: %s",
-					pattern,
+					pattern.Regexp,
 					source.Name,
 					err.Error(),
 				),
 			)
-		} else {
-			regexps = append(regexps, r)
+			continue
+		}
+		p := &Pattern{Regexp: r, Counter: source.Counter, Examples: pattern.Examples}
+		p.Counter, err = patternCounter(pattern, config, source.Counter)
+		if err != nil {
+			source.Warningf(
+				"invalid threshold for pattern %s in source %s: %s",
+				pattern.Regexp, source.Name, err.Error(),
+			)
+			continue
+		}
+		p.Conditions, err = newConditions(pattern.Conditions, r)
+		if err != nil {
+			source.Warningf(
+				"invalid condition for pattern %s in source %s: %s",
+				pattern.Regexp, source.Name, err.Error(),
+			)
+			continue
 		}
+		patterns = append(patterns, p)
 	}
-	if len(regexps) == 0 {
+	if len(patterns) == 0 {
 		source.Warning(
 			fmt.Sprintf(
 				"No valid regular expression defined for source %s",
 				source.Name),
 		)
 	}
-	source.Regexps = regexps
+	return patterns, nil
+}
 
-	var whitelist []net.IP
-	for _, address := range config.Whitelist {
-		ip := net.ParseIP(address)
-		if ip != nil {
-			whitelist = append(whitelist, ip)
-		} else {
-			source.Warning(
-				fmt.Sprintf("Invalid whitelist address %q in source %q", address, source.Name),
-			)
-		}
+// Close closes the files the source is using and saves their positions.
+func (source *Source) Close() {
+	source.Watcher.Unsubscribe(source)
+	source.Lock()
+	defer source.Unlock()
+	source.savePosition()
+	for _, f := range source.Files {
+		source.closeFile(f)
 	}
-	source.WhiteList = whitelist
+}
 
-	source.Config = config
-	if len(config.StatsInterval) > 0 {
-		interval, err := time.ParseDuration(config.StatsInterval)
+// Teardown removes what the blockers created for the source, if asked to.
+func (source *Source) Teardown() {
+	if source.Observe {
+		return
+	}
+	err := source.Blockers.Destroy()
+	if err != nil {
+		source.Err(err.Error())
+	}
+	if source.Aggregation != nil && !source.Aggregation.Shared {
+		err = source.Aggregation.Blockers.Destroy()
 		if err != nil {
-			source.Warning(err.Error())
-		}
-		if interval > 0 {
-			source.Stats.Interval = interval
+			source.Err(err.Error())
 		}
 	}
-	return
-}
-
-// Close tried to close the open files the source is using.
-func (source *Source) Close() {
-	source.Info(
-		fmt.Sprintf("ending %s watch", source.Name),
-	)
-	unix.InotifyRmWatch(source.FileDescriptor, uint32(source.WatchDescriptor))
-	source.Logger.Close()
-	source.Unlock()
 }
 
-// Watch starts watching the source file for matching patterns.
-func (source *Source) Watch() {
+// Watch starts watching the source files for matching patterns, with the
+// events from the given watcher, until it stops. The directories of the
+// files are watched too, for following the files when they are rotated, for
+// waiting for them when they do not exist yet and for finding the new ones
+// matching a glob. When polling, the files are read on every interval
+// instead.
+func (source *Source) Watch(watcher *Watcher) {
+	source.Watcher = watcher
+	source.Events = watcher.Subscribe(source)
 	defer source.Close()
 	var err error
 	source.Stats.Started = time.Now()
-	// Read file on start
-	source.Blacklist(source.read()...)
-	/*
-		inotify_init(2)
-		inotify_init() initializes a new inotify instance and returns a file
-		descriptor associated with a new inotify event queue.
-	*/
-	source.FileDescriptor, err = unix.InotifyInit()
-	if err != nil {
-		source.Err(err.Error())
-		return
+	source.Lock()
+	source.Files = make(map[string]*LogFile)
+	source.Directories = make(map[int]string)
+	for _, dir := range source.directories() {
+		err = source.watchDirectory(dir)
+		if err != nil {
+			break
+		}
 	}
-
-	err = source.inotifyAddWatch()
+	if err == nil {
+		err = source.scan()
+	}
+	source.Unlock()
 	if err != nil {
 		source.Err(err.Error())
 		return
 	}
+	// Read files on start, from where we left them
+	source.Blacklist(source.resume()...)
+	for _, f := range source.files() {
+		source.Blacklist(source.read(f)...)
+	}
 
-	events := make(chan uint32)
-	errors := make(chan error)
-
-	go func() {
-		var buf = make([]byte, unix.SizeofInotifyEvent+unix.NAME_MAX+1)
-		for {
-			_, err := unix.Read(source.FileDescriptor, buf)
-			if err != nil {
-				errors <- err
-			}
-			event := *(*unix.InotifyEvent)(unsafe.Pointer(&buf[0]))
-			events <- event.Mask
-		}
-	}()
-
+	// Polling the files, or checking that inotify works on them.
+	ticker := time.NewTicker(source.PollInterval)
+	defer ticker.Stop()
 	for {
 		select {
-		case err := <-errors:
-			source.Logger.Err(err.Error())
-			return
-		case event := <-events:
+		case event, ok := <-source.Events:
+			if !ok {
+				return
+			}
 			source.Stats.Events++
-			desc := fmt.Sprintf("%d", event)
-			switch event {
-			case unix.IN_MOVE_SELF:
-				desc = fmt.Sprintf("IN_MOVE_SELF(%d)", event)
-			case unix.IN_MODIFY:
-				desc = fmt.Sprintf("IN_MODIFY(%d)", event)
-			case unix.IN_DELETE_SELF:
-				desc = fmt.Sprintf("IN_DELETE_SELF(%d)", event)
+			err = source.handle(event)
+		case <-ticker.C:
+			err = source.poll()
+		}
+		if err != nil {
+			source.Err(err.Error())
+			return
+		}
+	}
+}
+
+// handle reads the new lines of the file, or follows the file, the event is
+// about.
+func (source *Source) handle(event inotifyEvent) error {
+	if event.Mask&unix.IN_Q_OVERFLOW != 0 {
+		source.Warningf("inotify events lost; reading all the files of %s", source.Name)
+		return source.resync()
+	}
+	if f, found := source.fileFor(event.Watch); found {
+		source.fileEvents++
+		if event.Mask&unix.IN_MODIFY != 0 {
+			// What was left in the rotated file comes first.
+			source.Blacklist(source.drain(f, time.Now())...)
+			source.Blacklist(source.read(f)...)
+		}
+		return nil
+	}
+	source.Lock()
+	dir, found := source.Directories[event.Watch]
+	source.Unlock()
+	if !found {
+		return nil
+	}
+	if event.Mask&(unix.IN_DELETE_SELF|unix.IN_MOVE_SELF|unix.IN_IGNORED) != 0 {
+		return fmt.Errorf("directory %s is gone", dir)
+	}
+	name := filepath.Join(dir, event.Name)
+	// Other files in the directory.
+	if !source.matches(name) {
+		return nil
+	}
+	source.fileEvents++
+	source.Debugf("inotify event %s on %s", event.String(), name)
+	source.Lock()
+	f, found := source.Files[name]
+	source.Unlock()
+	if !found {
+		if event.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) == 0 {
+			return nil
+		}
+		source.Lock()
+		f, err := source.follow(name)
+		source.Unlock()
+		if err != nil || f == nil {
+			return err
+		}
+		source.Blacklist(source.read(f)...)
+		return nil
+	}
+	// Whatever was written to the old file before it was replaced is read
+	// first.
+	source.Blacklist(source.read(f)...)
+	switch {
+	case event.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0:
+		err := source.Refresh(f)
+		if err != nil {
+			return err
+		}
+		source.Blacklist(source.read(f)...)
+	case event.Mask&unix.IN_MOVED_FROM != 0:
+		// The old file is still read, as it is written to until its writer
+		// reopens the log, which is usually after the new one is created.
+		source.Infof("file %s moved; waiting for the new one", name)
+	case event.Mask&unix.IN_DELETE != 0:
+		source.Lock()
+		source.forget(f)
+		source.Unlock()
+	}
+	return nil
+}
+
+// Blacklist add the matched IP addresses into the blocker, of the same family,
+// defined for the source.
+// IPv6 addresses are added as networks, if the source has a prefix length.
+// When observing, it only logs what it would have added.
+func (source *Source) Blacklist(matches ...Match) {
+	done := make(map[string]bool)
+	for _, match := range matches {
+		now := time.Now()
+		if match.Time.IsZero() {
+			match.Time = now
+		}
+		address := normalize(match.Address)
+		blocker, found := source.Blockers.For(address)
+		if !found {
+			source.Warningf("no blocker for address %s", address.String())
+			continue
+		}
+		network := source.network(address)
+		if done[network.String()] {
+			continue
+		}
+		done[network.String()] = true
+		if covering, found := source.Aggregation.Covered(network.IP, now); found {
+			source.Debugf("address %s is already banned with %s", address.String(), covering.String())
+			continue
+		}
+		offence := 0
+		timeout := source.BanTime
+		if source.Escalation != nil {
+			offence, timeout = source.Offences.BanTime(network.IP, source.Escalation, now)
+		}
+		if source.Observe {
+			source.observe(blocker, network, address, timeout, offence, match, now)
+			continue
+		}
+		added, err := blocker.Add(timeout, network)
+		if err != nil {
+			source.Err(err.Error())
+		}
+		source.Stats.IPAdded += len(added)
+		for _, n := range added {
+			message := fmt.Sprintf("added %s to %s", n.IP.String(), blocker.String())
+			if !isHost(n) {
+				message = fmt.Sprintf("added %s (%s) to %s", n.String(), address.String(), blocker.String())
 			}
-			// Any event that is not modify can lead to a new file, I
-			// don't know yet which events are relevant. When I do I will
-			// check filter them in (instead of using IN_ALL_EVENTS)
-			if event != unix.IN_MODIFY {
-				source.Debug(
-					fmt.Sprintf(
-						"inotify event %s on file %s", desc, source.LogFile,
-					),
-				)
-				time.Sleep(1 * time.Second)
-				err = source.Refresh()
+			if timeout > 0 {
+				message += fmt.Sprintf(" until %s", now.Add(timeout).Format(time.DateTime))
+			}
+			if offence > 0 {
+				message += fmt.Sprintf(" (offence %d)", offence)
+				err = source.Offences.Record(n.IP, offence, timeout, now)
 				if err != nil {
-					source.Err(err.Error())
-					return
+					source.Warningf("could not save offences: %s", err.Error())
 				}
 			}
-			source.Blacklist(source.read()...)
+			source.Info(message)
+			source.aggregate(blocker, n.IP, match.Time, now)
 		}
 	}
 }
 
-// Blacklist add the IP addresses into the nftables set defined for the source.
-func (source *Source) Blacklist(addresses ...net.IP) {
-	added, err := source.Set.Add(addresses...)
+// aggregate bans the network of the given address, replacing the single
+// addresses in the given blocker, if enough of its addresses have been banned;
+// when is the time of the ban event, now the one of the ban itself.
+func (source *Source) aggregate(blocker Blocker, ip net.IP, when time.Time, now time.Time) {
+	network, neighbours := source.Aggregation.Banned(ip, when)
+	if network == nil || source.spared(network) {
+		return
+	}
+	target, found := source.Aggregation.Blockers.For(ip)
+	if !found {
+		source.Warningf("no blocker for network %s", network.String())
+		return
+	}
+	var banned []*net.IPNet
+	for _, neighbour := range neighbours {
+		banned = append(banned, source.network(neighbour))
+	}
+	// The single addresses go first, as an interval set refuses overlapping
+	// elements when the network goes into the same set.
+	removed, err := blocker.Remove(banned...)
 	if err != nil {
 		source.Err(err.Error())
+		return
 	}
-	source.Stats.IPAdded += len(added)
-	for _, ip := range added {
-		source.Info(
-			fmt.Sprintf(
-				"added %s to @%s",
-				ip.String(), source.Set.Name,
-			),
-		)
+	banTime := source.Aggregation.BanTime
+	added, err := target.Add(banTime, network)
+	if err != nil || len(added) == 0 {
+		if err != nil {
+			source.Err(err.Error())
+		}
+		// Put back what was there.
+		_, err = blocker.Add(source.BanTime, removed...)
+		if err != nil {
+			source.Err(err.Error())
+		}
+		return
 	}
+	source.Aggregation.Ban(network, banTime, now)
+	source.Stats.NetworksAdded++
+	source.Infof(
+		"added %s to %s after %d banned addresses; removed %d addresses from %s",
+		network.String(), target.String(), len(neighbours), len(removed), blocker.String(),
+	)
 }
 
-// inotifyAddWatch adds a inotify watch for the given source.
-func (source *Source) inotifyAddWatch() error {
-	var err error
-	/*
-		inotify_add_watch(2)
-		inotify_add_watch() adds a new watch, or modifies an existing watch,
-		for the file whose location is specified in pathname; [...]
-		The fd argument is a file descriptor referring to the inotify instance
-		whose watch list is to be modified.
-		The events to be monitored for pathname are specified in the mask
-		bit-mask argument.
-		See inotify(7) for a description of the bits that can be set in mask.
-	*/
-	source.WatchDescriptor, err = unix.InotifyAddWatch(
-		source.FileDescriptor, source.LogFile,
-		unix.IN_MODIFY|unix.IN_MOVE_SELF|unix.IN_DELETE_SELF,
+// observe logs the network that would have been added to the blocker, with
+// the match that caused it, and the network it would have been aggregated
+// into, without touching the blockers nor the offences.
+func (source *Source) observe(blocker Blocker, network *net.IPNet, address net.IP, timeout time.Duration, offence int, match Match, now time.Time) {
+	source.Stats.WouldBan++
+	message := fmt.Sprintf("would have added %s to %s", network.IP.String(), blocker.String())
+	if !isHost(network) {
+		message = fmt.Sprintf("would have added %s (%s) to %s", network.String(), address.String(), blocker.String())
+	}
+	if timeout > 0 {
+		message += fmt.Sprintf(" until %s", now.Add(timeout).Format(time.DateTime))
+	}
+	if offence > 0 {
+		message += fmt.Sprintf(" (offence %d)", offence)
+	}
+	message += fmt.Sprintf("; pattern %s matched %q", match.Pattern, strings.TrimSpace(match.Line))
+	if len(match.Fields) > 0 {
+		message += " with " + formatFields(match.Fields)
+	}
+	source.Info(message)
+	aggregated, neighbours := source.Aggregation.Banned(network.IP, match.Time)
+	if aggregated == nil || source.spared(aggregated) {
+		return
+	}
+	target, found := source.Aggregation.Blockers.For(network.IP)
+	if !found {
+		return
+	}
+	// Recorded anyway, so that the addresses in it are not logged again.
+	source.Aggregation.Ban(aggregated, source.Aggregation.BanTime, now)
+	source.Stats.WouldBanNetworks++
+	source.Infof(
+		"would have added %s to %s after %d banned addresses",
+		aggregated.String(), target.String(), len(neighbours),
 	)
-	return err
 }
 
-// Refresh re-open a logfile if it has changed.
-func (source *Source) Refresh() error {
-	source.Lock()
-	defer source.Unlock()
-	current, err := os.Open(source.LogFile)
-	if err != nil {
-		return err
+// spared returns true, with a warning, if the network to aggregate into
+// has whitelisted or protected addresses, which are only checked for the
+// single addresses when matched.
+func (source *Source) spared(network *net.IPNet) bool {
+	if source.WhiteList.Overlaps(network) {
+		source.Warningf("not aggregating into %s, as it has whitelisted addresses", network.String())
+		return true
 	}
-	defer current.Close()
-	fileInfo, err := current.Stat()
-	if err != nil {
-		return err
-	}
-	// Deleted or moved
-	if !os.SameFile(fileInfo, source.FileInfo) {
-		source.Logger.Info(
-			fmt.Sprintf("re-opening %s file", source.LogFile),
+	if address, reason, found := source.Local.ProtectedIn(network); found {
+		source.Warningf(
+			"not aggregating into %s, as it has protected address %s (%s)",
+			network.String(), address, reason,
 		)
-		source.FileInfo = fileInfo
-		source.Pos = 0
-		unix.InotifyRmWatch(source.FileDescriptor, uint32(source.WatchDescriptor))
-		err = source.inotifyAddWatch()
-		if err != nil {
-			return err
-		}
+		return true
 	}
-	return nil
+	return false
+}
+
+// network returns the network the address is banned with: the address
+// itself, or its IPv6 network if the source has a prefix length.
+func (source *Source) network(ip net.IP) *net.IPNet {
+	ip = normalize(ip)
+	if ip.To4() != nil || source.IPv6PrefixLength == 0 {
+		return hostNetwork(ip)
+	}
+	mask := net.CIDRMask(source.IPv6PrefixLength, 128)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
 }
 
 // read looks for new log entries in the file and matches to the regexps.
-func (source *Source) read() []net.IP {
+func (source *Source) read(f *LogFile) []Match {
 	source.Lock()
 	defer source.Unlock()
 	blacklist := Blacklist{}
-	file, err := os.Open(source.LogFile)
-	if err != nil {
-		source.Err(err.Error())
-		return blacklist.Addresses()
+	if f.File == nil {
+		return blacklist.Matches()
 	}
-	defer file.Close()
-	source.FileInfo, err = file.Stat()
+	data, pos, fileInfo, err := f.shared.Read(source, f.Pos)
 	if err != nil {
 		source.Err(err.Error())
-		return blacklist.Addresses()
+		return blacklist.Matches()
 	}
-	if source.FileInfo.Size() < int64(source.Pos) {
+	f.FileInfo = fileInfo
+	// Truncated in place, like with copytruncate.
+	if pos != f.Pos {
 		source.Info(
 			fmt.Sprintf(
 				"file %s size changed to %d",
-				source.FileInfo.Name(),
-				source.FileInfo.Size(),
+				f.Path,
+				f.FileInfo.Size(),
 			),
 		)
-		source.Pos = 0
+		f.Pos = pos
 	}
+	bytesRead := source.readLines(bytes.NewReader(data), &blacklist)
+	f.Pos += bytesRead
+	source.Stats.BytesRead += bytesRead
+	if bytesRead > 0 {
+		source.savePosition()
+	}
+
+	return blacklist.Matches()
+}
+
+// readLines reads the lines from the reader, up to the last complete one,
+// and adds the addresses matched enough times to the blacklist. It returns
+// the bytes read; the caller must hold the lock.
+func (source *Source) readLines(r io.Reader, blacklist *Blacklist) uint64 {
 	var bytesRead uint64 = 0
-	file.Seek(int64(source.Pos), 0)
-	reader := bufio.NewReader(file)
+	reader := bufio.NewReader(r)
 	for {
-		var line []byte
-		line, err = reader.ReadBytes('\n')
+		line, err := reader.ReadBytes('\n')
 		if err != nil {
 			if err != io.EOF {
 				source.Err(err.Error())
@@ -325,41 +670,91 @@ func (source *Source) read() []net.IP {
 		}
 		source.Stats.LinesRead++
 		bytesRead += uint64(len(line))
-		for _, r := range source.Regexps {
-			addresses := source.parse(string(line), r)
-			if err != nil {
-				source.Warning(err.Error())
-				continue
+		if r := source.ignored(string(line)); r != nil {
+			source.Stats.Vetoed++
+			source.Debugf("line %+q ignored by pattern %s", strings.TrimSpace(string(line)), r.String())
+			continue
+		}
+		when, stale := source.when(string(line), time.Now())
+		if stale {
+			source.Stats.Stale++
+			continue
+		}
+		for _, p := range source.Patterns {
+			matches, _ := source.parse(string(line), p)
+			for _, match := range matches {
+				ip := match.Address
+				source.Stats.Matches++
+				ban, hits := p.Counter.Hit(source.network(ip).IP, when)
+				if !ban {
+					source.Debugf(
+						"address %s matched %d of %d times within %s",
+						ip.String(), hits, p.Counter.MaxMatches, p.Counter.Window,
+					)
+					continue
+				}
+				match.Time = when
+				blacklist.Add(match)
 			}
-			blacklist.Add(addresses...)
 		}
 	}
-	source.Pos += bytesRead
-	source.Stats.BytesRead += bytesRead
+	return bytesRead
+}
 
-	return blacklist.Addresses()
+// when returns the time of the line, from its timestamp or else the given
+// one, and true if it is older than the maximum age.
+func (source *Source) when(line string, now time.Time) (time.Time, bool) {
+	if source.Timestamp == nil {
+		return now, false
+	}
+	when, found := source.Timestamp.Parse(line, now)
+	if !found {
+		source.Debugf("no timestamp in line %+q", strings.TrimSpace(line))
+		return now, false
+	}
+	if source.MaxAge > 0 && now.Sub(when) > source.MaxAge {
+		source.Debugf("line %+q older than %s skipped", strings.TrimSpace(line), source.MaxAge)
+		return when, true
+	}
+	return when, false
 }
 
-// parse extracts the IP addresses from a given regexp from all the submatch and of the same type
-// as the nft set.
-func (source *Source) parse(line string, r *regexp.Regexp) []net.IP {
-	var addresses []net.IP
+// ignored returns the ignore pattern matching the line, if any.
+func (source *Source) ignored(line string) *regexp.Regexp {
+	for _, r := range source.IgnorePatterns {
+		if r.MatchString(line) {
+			return r
+		}
+	}
+	return nil
+}
+
+// parse extracts the IP addresses from the address groups of the pattern and of the same type
+// as the blockers, with the other named groups as fields of the match, when the conditions pass.
+// It also returns the captured text that is not an address.
+func (source *Source) parse(line string, p *Pattern) (matches []Match, invalid []string) {
+	r := p.Regexp
 	sm := r.FindAllStringSubmatch(line, -1)
 	// No match
 	if sm == nil {
-		return addresses
+		return
 	}
+	groups := addressGroups(r)
 	// There could be multiple matching
 	for _, m := range sm {
 		// m[0] is the matched text
 		// m[1] would be the first sub-match/capturing group
 		// m[2] the second capturing group if present, etc.
-		if len(m) < 2 {
-			// We don't bother if there are no sub-matches
+		f := fields(r, m)
+		if condition, passed := passes(p.Conditions, f); !passed {
+			source.Debugf(
+				"match %+q from regexp %s skipped, failing condition %s",
+				m[0], r.String(), condition.String(),
+			)
 			continue
 		}
 
-		for i := 1; i < len(m); i++ {
+		for _, i := range groups {
 			if len(m[i]) == 0 {
 				// Empty submatch, no point in trying to parse it.
 				continue
@@ -370,15 +765,17 @@ func (source *Source) parse(line string, r *regexp.Regexp) []net.IP {
 					"Invalid captured address %q from regexp %s on match %+q",
 					m[i], r.String(), m[0],
 				)
+				invalid = append(invalid, m[i])
 				continue
 			}
 
-			// We want to be sure we will not be feeding IPv6 addresses into a IPv4 nft set.
+			// We want to be sure we will not be feeding IPv6 addresses into a IPv4 blocker.
 			// It's a bit complex as all net.IP are 16 bytes, but the quickest way to decide if a net.IP is IPv4
-			// is through the net.IP.To4() function.
-			if source.Set.Type == IPV4 && ip.To4() == nil {
+			// is through the net.IP.To4() function, which also turns IPv4-mapped IPv6 addresses into IPv4.
+			ip = normalize(ip)
+			if _, found := source.Blockers.For(ip); !found {
 				source.Warningf(
-					"Matched address %s from %q is not a valid IPv4 address", m[i], m[0],
+					"Matched address %s from %q has no blocker of its family", m[i], m[0],
 				)
 				continue
 			}
@@ -386,28 +783,149 @@ func (source *Source) parse(line string, r *regexp.Regexp) []net.IP {
 			// Remove the IP from the matching string to avoid the regexp to match it again if the log is feed to the
 			// same log file.
 			source.Debugf(
-				"Address %s from %+q",
+				"Address %s from %+q %s",
 				m[i], strings.Replace(
 					m[0], m[i], "{address was here}",
 					-1),
+				formatFields(f),
 			)
 			// Try to avoid duplicates
-			if contains(addresses, ip) {
+			if slices.ContainsFunc(matches, func(match Match) bool { return match.Address.Equal(ip) }) {
 				continue
 			}
 
-			// Skip whitelisted addresses
+			// Skip whitelisted addresses; with a prefix length, the whole
+			// network that would be banned must be clear.
 			add := true
-			if slices.ContainsFunc(source.WhiteList, ip.Equal) {
-				source.Debugf("IP address %s is whitelisted", ip.String())
+			network := source.network(ip)
+			if source.WhiteList.Overlaps(network) {
+				source.Debugf("IP address %s (%s) is whitelisted", ip.String(), network.String())
+				add = false
+			} else if address, reason, found := source.Local.ProtectedIn(network); found {
+				source.Warningf(
+					"source %s tried to ban protected address %s (%s) with pattern %s",
+					source.Name, address, reason, r.String(),
+				)
 				add = false
 			}
 			if add {
-				addresses = append(addresses, ip)
+				matches = append(matches, Match{Address: ip, Pattern: r.String(), Line: line, Fields: f})
 			}
 		}
 	}
-	return addresses
+	return
+}
+
+// observing returns true if the given mode is the observe one.
+func observing(mode string) (bool, error) {
+	switch strings.ToLower(mode) {
+	case "", MODE_ENFORCE:
+		return false, nil
+	case MODE_OBSERVE:
+		return true, nil
+	}
+	return false, fmt.Errorf("invalid mode %q", mode)
+}
+
+// startAt returns where to start reading the log file from, START_SAVED by
+// default.
+func startAt(value string) (string, error) {
+	switch strings.ToLower(value) {
+	case "", START_SAVED:
+		return START_SAVED, nil
+	case START_END, START_BEGINNING:
+		return strings.ToLower(value), nil
+	}
+	return "", fmt.Errorf("invalid start_at %q", value)
+}
+
+// newTimestamp returns the timestamp and the maximum age of the lines of the
+// source, if configured.
+func newTimestamp(config *SourceConfig) (*Timestamp, time.Duration, error) {
+	var maxAge time.Duration
+	if len(config.MaxAge) > 0 {
+		var err error
+		maxAge, err = parseDuration(config.MaxAge)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid max_age %q: %w", config.MaxAge, err)
+		}
+	}
+	if len(config.TimestampFormat) == 0 {
+		if maxAge > 0 {
+			return nil, 0, errors.New("max_age without timestamp_format")
+		}
+		if len(config.TimestampRegexp) > 0 {
+			return nil, 0, errors.New("timestamp_regexp without timestamp_format")
+		}
+		return nil, 0, nil
+	}
+	timestamp, err := NewTimestamp(config.TimestampFormat, config.TimestampRegexp)
+	return timestamp, maxAge, err
+}
+
+// newCounter returns a counter for the given threshold, or nil if every match
+// should be blacklisted straight away.
+func newCounter(maxMatches int, window string) (*Counter, error) {
+	if maxMatches < 0 {
+		return nil, fmt.Errorf("negative max_matches %d", maxMatches)
+	}
+	if maxMatches <= 1 {
+		return nil, nil
+	}
+	if len(window) == 0 {
+		window = DEFAULT_FIND_WINDOW
+	}
+	interval, err := parseDuration(window)
+	if err != nil {
+		return nil, err
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("find_window %q must be positive", window)
+	}
+	return NewCounter(maxMatches, interval), nil
+}
+
+// compileIgnorePatterns compiles the ignore patterns of the source, with the
+// macros of its patterns and preset; as an invalid one would let through
+// what it should veto, it is an error.
+func compileIgnorePatterns(config *SourceConfig) ([]*regexp.Regexp, error) {
+	var patterns []*regexp.Regexp
+	if len(config.IgnorePatterns) == 0 {
+		return patterns, nil
+	}
+	_, definitions, err := sourcePatterns(config)
+	if err != nil {
+		return nil, err
+	}
+	for _, pattern := range config.IgnorePatterns {
+		expanded, err := expand(pattern, definitions)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ignore pattern %s: %w", pattern, err)
+		}
+		r, err := regexp.Compile(expanded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ignore pattern %s: %w", pattern, err)
+		}
+		patterns = append(patterns, r)
+	}
+	return patterns, nil
+}
+
+// patternCounter returns the counter of the pattern: its own, if it has its
+// own threshold, or the one of the source.
+func patternCounter(pattern PatternConfig, config *SourceConfig, counter *Counter) (*Counter, error) {
+	if pattern.MaxMatches == 0 && len(pattern.FindWindow) == 0 {
+		return counter, nil
+	}
+	maxMatches := pattern.MaxMatches
+	if maxMatches == 0 {
+		maxMatches = config.MaxMatches
+	}
+	window := pattern.FindWindow
+	if len(window) == 0 {
+		window = config.FindWindow
+	}
+	return newCounter(maxMatches, window)
 }
 
 // contains a simple function to check if an IP is already contained in an existing
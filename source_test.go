@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestAggregateSpared(t *testing.T) {
+	tests := []struct {
+		name      string
+		whitelist []string
+		global    []string
+		local     map[string]string
+		want      []string
+	}{
+		{
+			"nothing spared", nil, nil, nil,
+			[]string{"192.0.2.0/24"},
+		},
+		{
+			"whitelisted address", []string{"192.0.2.10"}, nil, nil,
+			[]string{"192.0.2.1/32", "192.0.2.2/32", "192.0.2.3/32"},
+		},
+		{
+			"globally whitelisted network", nil, []string{"192.0.2.128/25"}, nil,
+			[]string{"192.0.2.1/32", "192.0.2.2/32", "192.0.2.3/32"},
+		},
+		{
+			"whitelist elsewhere", []string{"198.51.100.10"}, nil, nil,
+			[]string{"192.0.2.0/24"},
+		},
+		{
+			"protected gateway", nil, nil, map[string]string{"192.0.2.254": "gateway"},
+			[]string{"192.0.2.1/32", "192.0.2.2/32", "192.0.2.3/32"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, observe := range []bool{false, true} {
+				blocker := NewMemoryBlocker("test")
+				source := &Source{Name: "test", Blockers: Blockers{blocker}, Observe: observe}
+				var err error
+				source.Aggregation, err = NewAggregation(&AggregateConfig{Addresses: 3}, source.Blockers, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				source.WhiteList, _ = NewWhitelist(test.whitelist, nil, nil)
+				source.WhiteList.Parent, _ = NewWhitelist(test.global, nil, nil)
+				if test.local != nil {
+					source.Local = &LocalAddresses{Refreshed: time.Now(), addresses: test.local}
+				}
+				for _, address := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+					source.Blacklist(Match{Address: net.ParseIP(address)})
+				}
+				if observe {
+					// Nothing is added, but the network is recorded as
+					// banned only if it would have been.
+					_, covered := source.Aggregation.Covered(net.ParseIP("192.0.2.4"), time.Now())
+					if want := slices.Contains(test.want, "192.0.2.0/24"); covered != want {
+						t.Errorf("observing: network banned %t, want %t", covered, want)
+					}
+					continue
+				}
+				networks, _ := blocker.List()
+				var got []string
+				for _, network := range networks {
+					got = append(got, network.String())
+				}
+				if !slices.Equal(got, test.want) {
+					t.Errorf("blocked %v, want %v", got, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestCompileIgnorePatternsPreset(t *testing.T) {
+	config := &SourceConfig{
+		Preset:         "postfix",
+		IgnorePatterns: []string{`from <CLIENT>: 554`},
+	}
+	patterns, err := compileIgnorePatterns(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := "NOQUEUE: reject: RCPT from unknown[192.0.2.1]: 554 5.7.1 Relay access denied"
+	if len(patterns) != 1 || !patterns[0].MatchString(line) {
+		t.Errorf("ignore pattern %v does not match %q", patterns, line)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+// Where to start reading a log file.
+const (
+	// START_SAVED resumes from the saved position, or the beginning of the file.
+	START_SAVED = "saved"
+	// START_END resumes from the saved position, or the end of the file.
+	START_END = "end"
+	// START_BEGINNING always reads the whole file, ignoring the saved position.
+	START_BEGINNING = "beginning"
+)
+
+// Position is the read offset of a log file, saved between restarts; the
+// positions of all the files of a source are kept in one file.
+// The device and inode tell if the file is still the same one; the
+// fingerprint finds it once rotated and compressed.
+type Position struct {
+	File            string `json:"file"`
+	Device          uint64 `json:"device"`
+	Inode           uint64 `json:"inode"`
+	Pos             uint64 `json:"pos"`
+	Fingerprint     string `json:"fingerprint,omitempty"`
+	FingerprintSize int    `json:"fingerprint_size,omitempty"`
+}
+
+// positionFile returns the name of the file keeping the position of the
+// given source in the state directory.
+func positionFile(stateDir string, name string) string {
+	name = strings.ReplaceAll(name, string(filepath.Separator), "_")
+	return filepath.Join(stateDir, name+".pos")
+}
+
+// fileID returns the device and inode of the given file.
+func fileID(fileInfo os.FileInfo) (device uint64, inode uint64) {
+	if fileInfo == nil {
+		return
+	}
+	if stat, ok := fileInfo.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Dev), stat.Ino
+	}
+	return
+}
+
+// loadPositions reads the saved positions; a single one is from before a
+// source could follow more than one file.
+func loadPositions(file string) ([]Position, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var positions []Position
+	err = json.Unmarshal(data, &positions)
+	if err == nil {
+		return positions, nil
+	}
+	var position Position
+	if json.Unmarshal(data, &position) == nil {
+		return []Position{position}, nil
+	}
+	return nil, err
+}
+
+// savePositions writes the positions to the given file.
+func savePositions(file string, positions []Position) error {
+	data, err := json.Marshal(positions)
+	if err != nil {
+		return err
+	}
+	return writeState(file, data)
+}
+
+// writeState writes a state file to a temporary file and renames it over the
+// previous one, so that a crash does not leave a truncated file.
+func writeState(file string, data []byte) error {
+	return writeFile(file, data, 0600, 0700)
+}
+
+// writeFile writes a file atomically, with the given permissions, creating
+// its directory with the given ones if missing.
+func writeFile(file string, data []byte, perm os.FileMode, dirPerm os.FileMode) error {
+	err := os.MkdirAll(filepath.Dir(file), dirPerm)
+	if err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	err = os.WriteFile(tmp, data, perm)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// resume sets the position to start reading the log files from, according to
+// the start_at setting of the source. A file rotated since the position was
+// saved is caught up with first, returning what it matched.
+func (source *Source) resume() []Match {
+	source.Lock()
+	defer source.Unlock()
+	blacklist := Blacklist{}
+	if source.StartAt == START_BEGINNING {
+		return blacklist.Matches()
+	}
+	var positions []Position
+	if len(source.StateFile) > 0 {
+		var err error
+		positions, err = loadPositions(source.StateFile)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			source.Warningf("could not load positions of %s: %s", source.Name, err.Error())
+		}
+	}
+	for _, f := range source.Files {
+		i := slices.IndexFunc(positions, func(p Position) bool { return p.File == f.Path })
+		if i >= 0 {
+			position := positions[i]
+			device, inode := fileID(f.FileInfo)
+			if f.File != nil && position.Device == device && position.Inode == inode &&
+				position.Pos <= uint64(f.FileInfo.Size()) && f.same(position) {
+				source.Infof("resuming %s from byte %d", f.Path, position.Pos)
+				f.Pos = position.Pos
+				continue
+			}
+			// The file being read now comes after the one caught up
+			// with, and is read from its beginning.
+			if source.catchUp(f, position, &blacklist) {
+				continue
+			}
+			if f.File != nil {
+				source.Infof("saved position for %s is for another file", f.Path)
+			}
+		}
+		// A file created later is read from its beginning.
+		if f.File == nil {
+			continue
+		}
+		if source.StartAt == START_END {
+			source.Infof("starting %s from the end", f.Path)
+			f.Pos = uint64(f.FileInfo.Size())
+		}
+	}
+	return blacklist.Matches()
+}
+
+// savePosition writes the current positions of the files of the source in
+// the state directory; the caller must hold the lock.
+// An observing source resumes from the saved positions but never moves them,
+// so that an enforcing run reads again what it only observed, and a dry run
+// does not overwrite the positions of the running daemon.
+func (source *Source) savePosition() {
+	if len(source.StateFile) == 0 || source.Observe {
+		return
+	}
+	var positions []Position
+	for _, f := range source.Files {
+		if f.File == nil {
+			continue
+		}
+		f.fingerprint()
+		device, inode := fileID(f.FileInfo)
+		positions = append(positions, Position{
+			File:            f.Path,
+			Device:          device,
+			Inode:           inode,
+			Pos:             f.Pos,
+			Fingerprint:     f.Fingerprint,
+			FingerprintSize: f.FingerprintSize,
+		})
+	}
+	slices.SortFunc(positions, func(a, b Position) int { return strings.Compare(a.File, b.File) })
+	err := savePositions(source.StateFile, positions)
+	if err != nil {
+		source.Warning(
+			fmt.Sprintf("could not save positions of %s: %s", source.Name, err.Error()),
+		)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"runtime"
+	"strings"
 	"time"
 )
 
@@ -10,17 +11,34 @@ type Stats struct {
 	Started   time.Time
 	BytesRead uint64
 	LinesRead uint64
+	Matches   uint64
 	IPAdded   int
-	Events    int
-	Interval  time.Duration
+	// NetworksAdded is the number of networks banned by aggregation.
+	NetworksAdded int
+	// WouldBan and WouldBanNetworks are the addresses and the networks
+	// that would have been added, when observing.
+	WouldBan         int
+	WouldBanNetworks int
+	// Vetoed is the number of lines skipped for matching an ignore pattern.
+	Vetoed int
+	// Stale is the number of lines skipped for being older than max_age.
+	Stale    int
+	Events   int
+	Interval time.Duration
 }
 
 func (source *Source) LogStats() {
 	now := time.Now()
 	source.Debug(
-		fmt.Sprintf("source %+q log file: %s",
+		fmt.Sprintf("source %+q log files: %s",
 			source.Name,
-			source.LogFile,
+			strings.Join(source.LogFiles, ", "),
+		),
+	)
+	source.Debug(
+		fmt.Sprintf("source %+q follow mode: %s",
+			source.Name,
+			source.followMode(),
 		),
 	)
 	source.Debug(
@@ -37,27 +55,86 @@ func (source *Source) LogStats() {
 			formatBytes(source.Stats.BytesRead),
 		),
 	)
+	for _, f := range source.files() {
+		source.Debug(
+			fmt.Sprintf(
+				"source %+q bytes read current log file %s: %s",
+				source.Name,
+				f.Path,
+				formatBytes(f.Pos),
+			),
+		)
+	}
 	source.Debug(
 		fmt.Sprintf(
-			"source %+q bytes read current log file: %s",
+			"source %+q lines processed: %d",
 			source.Name,
-			formatBytes(uint64(source.Pos)),
+			source.Stats.LinesRead,
 		),
 	)
 	source.Debug(
-		fmt.Sprintf(
-			"source %+q lines processed: %d",
+		fmt.Sprintf("source %+q addresses matched: %d",
 			source.Name,
-			source.Stats.LinesRead,
+			source.Stats.Matches,
 		),
 	)
+	if len(source.IgnorePatterns) > 0 {
+		source.Debug(
+			fmt.Sprintf("source %+q lines vetoed by ignore patterns: %d",
+				source.Name,
+				source.Stats.Vetoed,
+			),
+		)
+	}
+	if source.MaxAge > 0 {
+		source.Debug(
+			fmt.Sprintf("source %+q lines older than %s: %d",
+				source.Name,
+				source.MaxAge,
+				source.Stats.Stale,
+			),
+		)
+	}
 	source.Debug(
-		fmt.Sprintf("source %+q addresses added to @%s: %d",
+		fmt.Sprintf("source %+q addresses pending threshold: %d",
 			source.Name,
-			source.Set.Name,
+			source.Counter.Len(),
+		),
+	)
+	source.Debug(
+		fmt.Sprintf("source %+q addresses added to %s: %d",
+			source.Name,
+			source.Blockers.String(),
 			source.Stats.IPAdded,
 		),
 	)
+	if source.Observe {
+		source.Debug(
+			fmt.Sprintf("source %+q addresses that would have been added: %d (networks: %d)",
+				source.Name,
+				source.Stats.WouldBan,
+				source.Stats.WouldBanNetworks,
+			),
+		)
+	}
+	if source.Aggregation != nil {
+		source.Debug(
+			fmt.Sprintf("source %+q networks added to %s: %d (%d currently banned)",
+				source.Name,
+				source.Aggregation.Blockers.String(),
+				source.Stats.NetworksAdded,
+				source.Aggregation.Len(),
+			),
+		)
+	}
+	if source.Escalation != nil {
+		source.Debug(
+			fmt.Sprintf("source %+q repeat offenders: %d",
+				source.Name,
+				source.Offences.Repeated(),
+			),
+		)
+	}
 	source.Debug(
 		fmt.Sprintf("source %+q events received: %d",
 			source.Name,
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"log"
 	"log/syslog"
 	"strings"
 )
@@ -65,52 +66,63 @@ func severity(keyword string) syslog.Priority {
 	return syslog.LOG_INFO
 }
 
+// write logs the message with the given syslog writer method, or to the
+// standard logger when the source has no syslog writer (e.g. when testing
+// patterns from the command line).
+func (source *Source) write(method func(string) error, message string) {
+	if source.Logger == nil {
+		log.Print(message)
+		return
+	}
+	method(message)
+}
+
 func (source *Source) Debug(message string) {
 	if source.LogLevel >= syslog.LOG_DEBUG {
-		source.Logger.Debug(message)
+		source.write(source.Logger.Debug, message)
 	}
 }
 
 func (source *Source) Info(message string) {
 	if source.LogLevel >= syslog.LOG_INFO {
-		source.Logger.Info(message)
+		source.write(source.Logger.Info, message)
 	}
 }
 
 func (source *Source) Notice(message string) {
 	if source.LogLevel >= syslog.LOG_NOTICE {
-		source.Logger.Notice(message)
+		source.write(source.Logger.Notice, message)
 	}
 }
 
 // Warning
 func (source *Source) Warning(message string) {
 	if source.LogLevel >= syslog.LOG_WARNING {
-		source.Logger.Warning(message)
+		source.write(source.Logger.Warning, message)
 	}
 }
 
 func (source *Source) Err(message string) {
 	if source.LogLevel >= syslog.LOG_ERR {
-		source.Logger.Err(message)
+		source.write(source.Logger.Err, message)
 	}
 }
 
 func (source *Source) Crit(message string) {
 	if source.LogLevel >= syslog.LOG_CRIT {
-		source.Logger.Crit(message)
+		source.write(source.Logger.Crit, message)
 	}
 }
 
 func (source *Source) Alert(message string) {
 	if source.LogLevel >= syslog.LOG_ALERT {
-		source.Logger.Alert(message)
+		source.write(source.Logger.Alert, message)
 	}
 }
 
 func (source *Source) Emerg(message string) {
 	if source.LogLevel >= syslog.LOG_EMERG {
-		source.Logger.Emerg(message)
+		source.write(source.Logger.Emerg, message)
 	}
 }
 
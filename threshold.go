@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// DEFAULT_FIND_WINDOW is the window used when a threshold has no find_window.
+const DEFAULT_FIND_WINDOW = "10m"
+
+// Counter keeps track of the matches for each IP address, so that an address
+// is blacklisted only after a given number of matches within a time window.
+type Counter struct {
+	sync.Mutex
+	MaxMatches int
+	Window     time.Duration
+	hits       map[string][]time.Time
+	purged     time.Time
+}
+
+// NewCounter returns a counter for the given threshold.
+func NewCounter(maxMatches int, window time.Duration) *Counter {
+	return &Counter{
+		MaxMatches: maxMatches,
+		Window:     window,
+		hits:       make(map[string][]time.Time),
+	}
+}
+
+// Hit records a match for the given address at the given time, the one of
+// the event, and returns true, and the number of hits, when the threshold has
+// been reached.
+// The hits of an address are forgotten once it crosses the threshold.
+func (c *Counter) Hit(ip net.IP, when time.Time) (bool, int) {
+	if c == nil || c.MaxMatches <= 1 {
+		return true, 1
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.purge(when)
+	key := ip.String()
+	hits := c.hits[key]
+	// Lines from different files may come out of order, as the times are
+	// the ones of the events: the window ends with the latest hit, not
+	// with this one, and a late hit older than the window is dropped.
+	i, _ := slices.BinarySearchFunc(hits, when, time.Time.Compare)
+	hits = slices.Insert(hits, i, when)
+	hits = c.expire(hits, hits[len(hits)-1])
+	if len(hits) >= c.MaxMatches {
+		delete(c.hits, key)
+		return true, len(hits)
+	}
+	c.hits[key] = hits
+	return false, len(hits)
+}
+
+// Len returns the number of addresses with pending hits.
+func (c *Counter) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.Lock()
+	defer c.Unlock()
+	return len(c.hits)
+}
+
+// expire removes the hits older than the window.
+func (c *Counter) expire(hits []time.Time, now time.Time) []time.Time {
+	if c.Window <= 0 {
+		return hits
+	}
+	limit := now.Add(-c.Window)
+	i := 0
+	for i < len(hits) && !hits[i].After(limit) {
+		i++
+	}
+	return hits[i:]
+}
+
+// purge drops the addresses whose hits are all expired; it runs at most once
+// per window so that addresses seen only once do not pile up in memory.
+func (c *Counter) purge(now time.Time) {
+	if c.Window <= 0 || now.Sub(c.purged) < c.Window {
+		return
+	}
+	for key, hits := range c.hits {
+		hits = c.expire(hits, now)
+		if len(hits) == 0 {
+			delete(c.hits, key)
+		} else {
+			c.hits[key] = hits
+		}
+	}
+	c.purged = now
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCounterHit(t *testing.T) {
+	start := time.Date(2024, time.February, 1, 10, 0, 0, 0, time.UTC)
+	type hit struct {
+		at   time.Duration
+		ban  bool
+		hits int
+	}
+	tests := []struct {
+		name       string
+		maxMatches int
+		hits       []hit
+	}{
+		{"in order", 3, []hit{
+			{0, false, 1}, {time.Minute, false, 2}, {2 * time.Minute, true, 3},
+		}},
+		{"expired in order", 3, []hit{
+			{0, false, 1}, {time.Minute, false, 2}, {12 * time.Minute, false, 1}, {13 * time.Minute, false, 2}, {14 * time.Minute, true, 3},
+		}},
+		{"forgotten once banned", 2, []hit{
+			{0, false, 1}, {time.Minute, true, 2}, {2 * time.Minute, false, 1},
+		}},
+		{"out of order within the window", 3, []hit{
+			{5 * time.Minute, false, 1}, {0, false, 2}, {8 * time.Minute, true, 3},
+		}},
+		{"late hit within the window of the latest", 3, []hit{
+			{20 * time.Minute, false, 1}, {12 * time.Minute, false, 2}, {15 * time.Minute, true, 3},
+		}},
+		{"late hit older than the window", 3, []hit{
+			{20 * time.Minute, false, 1}, {5 * time.Minute, false, 1}, {21 * time.Minute, false, 2},
+		}},
+		{"late hit expiring none", 3, []hit{
+			{10 * time.Minute, false, 1}, {0, false, 1}, {time.Minute, false, 2}, {10 * time.Minute, true, 3},
+		}},
+		{"same time", 3, []hit{
+			{0, false, 1}, {0, false, 2}, {0, true, 3},
+		}},
+		{"every match", 1, []hit{
+			{0, true, 1}, {time.Hour, true, 1},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			counter := NewCounter(test.maxMatches, 10*time.Minute)
+			for i, h := range test.hits {
+				ban, hits := counter.Hit(net.ParseIP("192.0.2.1"), start.Add(h.at))
+				if ban != h.ban || hits != h.hits {
+					t.Errorf("hit %d at %s: %t, %d; want %t, %d", i, h.at, ban, hits, h.ban, h.hits)
+				}
+			}
+		})
+	}
+}
+
+func TestCounterHitAddresses(t *testing.T) {
+	start := time.Date(2024, time.February, 1, 10, 0, 0, 0, time.UTC)
+	counter := NewCounter(2, 10*time.Minute)
+	counter.Hit(net.ParseIP("192.0.2.1"), start)
+	ban, hits := counter.Hit(net.ParseIP("192.0.2.2"), start.Add(time.Minute))
+	if ban || hits != 1 {
+		t.Errorf("other address: %t, %d; want false, 1", ban, hits)
+	}
+	if counter.Len() != 2 {
+		t.Errorf("Len = %d, want 2", counter.Len())
+	}
+	// Expired hits are purged once per window.
+	counter.Hit(net.ParseIP("192.0.2.3"), start.Add(time.Hour))
+	if counter.Len() != 1 {
+		t.Errorf("Len after purge = %d, want 1", counter.Len())
+	}
+}
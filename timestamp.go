@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Timestamp formats of the log lines, besides a custom Go layout.
+const (
+	// TIMESTAMP_SYSLOG is the RFC3164 "Jan _2 15:04:05", without year.
+	TIMESTAMP_SYSLOG = "syslog"
+	// TIMESTAMP_RFC5424 and TIMESTAMP_ISO8601 are "2006-01-02T15:04:05",
+	// with optional fraction and zone; a space may replace the T.
+	TIMESTAMP_RFC5424 = "rfc5424"
+	TIMESTAMP_ISO8601 = "iso8601"
+	// TIMESTAMP_COMMON is the nginx and apache common log format.
+	TIMESTAMP_COMMON = "common"
+)
+
+// timestampFormats are the regexps locating the timestamp of the named
+// formats, in the first group, and the layouts it is parsed with.
+var timestampFormats = map[string]struct {
+	regexp  string
+	layouts []string
+}{
+	TIMESTAMP_SYSLOG: {
+		`^(?:<[0-9]+>)?([A-Z][a-z]{2} [ 0-9][0-9] [0-9]{2}:[0-9]{2}:[0-9]{2})`,
+		[]string{time.Stamp},
+	},
+	TIMESTAMP_RFC5424: {
+		`([0-9]{4}-[0-9]{2}-[0-9]{2}[T ][0-9]{2}:[0-9]{2}:[0-9]{2}(?:\.[0-9]+)?(?:Z|[+-][0-9]{2}:?[0-9]{2})?)`,
+		[]string{
+			"2006-01-02T15:04:05Z07:00", "2006-01-02T15:04:05Z0700", "2006-01-02T15:04:05",
+			"2006-01-02 15:04:05Z07:00", "2006-01-02 15:04:05Z0700", "2006-01-02 15:04:05",
+		},
+	},
+	TIMESTAMP_COMMON: {
+		`\[([0-9]{2}/[A-Z][a-z]{2}/[0-9]{4}:[0-9]{2}:[0-9]{2}:[0-9]{2} [+-][0-9]{4})\]`,
+		[]string{"02/Jan/2006:15:04:05 -0700"},
+	},
+}
+
+// layoutElements are the elements of a Go layout, longest first, with the
+// regexps matching their values; the fractional seconds are apart, as they
+// are any number of 0 or 9.
+var layoutElements = []struct {
+	element string
+	regexp  string
+}{
+	{"January", `[A-Z][a-z]+`},
+	{"Monday", `[A-Z][a-z]+`},
+	{"Jan", `[A-Z][a-z]{2}`},
+	{"Mon", `[A-Z][a-z]{2}`},
+	{"MST", `(?:[A-Z]{3,5}|[+-][0-9]{2,4})`},
+	{"2006", `[0-9]{4}`},
+	{"Z07:00:00", `(?:Z|[+-][0-9]{2}:[0-9]{2}:[0-9]{2})`},
+	{"-07:00:00", `[+-][0-9]{2}:[0-9]{2}:[0-9]{2}`},
+	{"Z07:00", `(?:Z|[+-][0-9]{2}:[0-9]{2})`},
+	{"-07:00", `[+-][0-9]{2}:[0-9]{2}`},
+	{"Z0700", `(?:Z|[+-][0-9]{4})`},
+	{"-0700", `[+-][0-9]{4}`},
+	{"Z07", `(?:Z|[+-][0-9]{2})`},
+	{"-07", `[+-][0-9]{2}`},
+	{"_2006", `_[0-9]{4}`},
+	{"__2", `[ 0-9]{2}[0-9]`},
+	{"002", `[0-9]{3}`},
+	{"_2", `[ 0-9][0-9]`},
+	// The seconds may be followed by a fraction even if the layout has
+	// none.
+	{"05", `[0-9]{2}(?:[.,][0-9]+)?`},
+	{"01", `[0-9]{2}`},
+	{"02", `[0-9]{2}`},
+	{"03", `[0-9]{2}`},
+	{"04", `[0-9]{2}`},
+	{"06", `[0-9]{2}`},
+	{"15", `[0-9]{2}`},
+	{"PM", `[AP]M`},
+	{"pm", `[ap]m`},
+	{"5", `[0-9]{1,2}(?:[.,][0-9]+)?`},
+	{"1", `[0-9]{1,2}`},
+	{"2", `[0-9]{1,2}`},
+	{"3", `[0-9]{1,2}`},
+	{"4", `[0-9]{1,2}`},
+}
+
+// fractionElement matches the fractional seconds of a layout: with 0s they
+// must all be there, with 9s they are optional.
+var fractionElement = regexp.MustCompile(`^[.,](0+|9+)`)
+
+// layoutRegexp returns the regexp matching the values of the Go layout.
+func layoutRegexp(layout string) string {
+	var b strings.Builder
+	for len(layout) > 0 {
+		// Followed by a digit, it is not an element.
+		if m := fractionElement.FindStringSubmatch(layout); m != nil && !startsWithDigit(layout[len(m[0]):]) {
+			if m[1][0] == '0' {
+				fmt.Fprintf(&b, `[.,][0-9]{%d}`, len(m[1]))
+			} else {
+				b.WriteString(`(?:[.,][0-9]+)?`)
+			}
+			layout = layout[len(m[0]):]
+			continue
+		}
+		found := false
+		for _, e := range layoutElements {
+			if rest, ok := strings.CutPrefix(layout, e.element); ok {
+				b.WriteString(e.regexp)
+				layout = rest
+				found = true
+				break
+			}
+		}
+		if !found {
+			b.WriteString(regexp.QuoteMeta(layout[:1]))
+			layout = layout[1:]
+		}
+	}
+	return b.String()
+}
+
+// startsWithDigit returns true if the string starts with a digit.
+func startsWithDigit(s string) bool {
+	return len(s) > 0 && s[0] >= '0' && s[0] <= '9'
+}
+
+// Timestamp extracts the time of the log lines.
+type Timestamp struct {
+	// Regexp locates the timestamp, in its first group if it has one.
+	Regexp  *regexp.Regexp
+	Layouts []string
+}
+
+// NewTimestamp returns the timestamp of the given format, a named one or a
+// Go layout, optionally located by the given regexp.
+func NewTimestamp(format string, pattern string) (*Timestamp, error) {
+	t := &Timestamp{}
+	name := strings.ToLower(format)
+	if name == TIMESTAMP_ISO8601 {
+		name = TIMESTAMP_RFC5424
+	}
+	if named, found := timestampFormats[name]; found {
+		t.Layouts = named.layouts
+		if len(pattern) == 0 {
+			pattern = named.regexp
+		}
+	} else {
+		// A layout must at least have a number of the time in it.
+		if !strings.ContainsAny(format, "0123456789") {
+			return nil, fmt.Errorf("unknown timestamp format %q", format)
+		}
+		t.Layouts = []string{format}
+		// Values may be of different lengths, like with fractions or
+		// month names.
+		if len(pattern) == 0 {
+			pattern = "^" + layoutRegexp(format)
+		}
+	}
+	var err error
+	t.Regexp, err = regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp regexp: %w", err)
+	}
+	return t, nil
+}
+
+// Parse returns the time of the line, in local time when the timestamp has
+// no zone. A timestamp without a year is in the last twelve months.
+func (t *Timestamp) Parse(line string, now time.Time) (time.Time, bool) {
+	m := t.Regexp.FindStringSubmatch(line)
+	if m == nil {
+		return time.Time{}, false
+	}
+	value := m[0]
+	if len(m) > 1 {
+		value = m[1]
+	}
+	for _, layout := range t.Layouts {
+		when, err := time.ParseInLocation(layout, value, time.Local)
+		if err != nil {
+			continue
+		}
+		if when.Year() == 0 {
+			when = when.AddDate(now.Year(), 0, 0)
+			// Allowing for clocks slightly off.
+			if when.After(now.Add(24 * time.Hour)) {
+				when = when.AddDate(-1, 0, 0)
+			}
+		}
+		return when, true
+	}
+	return time.Time{}, false
+}
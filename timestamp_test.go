@@ -0,0 +1,144 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimestampParse(t *testing.T) {
+	now := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.Local)
+	plus2 := time.FixedZone("", 2*60*60)
+	tests := []struct {
+		name   string
+		format string
+		regexp string
+		line   string
+		want   time.Time
+		found  bool
+	}{
+		{
+			"syslog", TIMESTAMP_SYSLOG, "",
+			"Feb  1 10:00:00 host sshd[1]: Failed password",
+			time.Date(2024, time.February, 1, 10, 0, 0, 0, time.Local), true,
+		},
+		{
+			"syslog with priority", TIMESTAMP_SYSLOG, "",
+			"<13>Feb 11 10:00:00 host sshd[1]: Failed password",
+			time.Date(2024, time.February, 11, 10, 0, 0, 0, time.Local), true,
+		},
+		{
+			"syslog from last year", TIMESTAMP_SYSLOG, "",
+			"Dec 31 23:59:59 host sshd[1]: Failed password",
+			time.Date(2023, time.December, 31, 23, 59, 59, 0, time.Local), true,
+		},
+		{
+			"syslog slightly in the future", TIMESTAMP_SYSLOG, "",
+			"Mar  1 18:00:00 host sshd[1]: Failed password",
+			time.Date(2024, time.March, 1, 18, 0, 0, 0, time.Local), true,
+		},
+		{
+			"rfc5424 in UTC", TIMESTAMP_RFC5424, "",
+			"<34>1 2024-02-01T10:00:00Z host sshd 1 - - Failed password",
+			time.Date(2024, time.February, 1, 10, 0, 0, 0, time.UTC), true,
+		},
+		{
+			"rfc5424 with a fraction and an offset", TIMESTAMP_RFC5424, "",
+			"<34>1 2024-02-01T10:00:00.123+02:00 host sshd 1 - - Failed password",
+			time.Date(2024, time.February, 1, 10, 0, 0, 123000000, plus2), true,
+		},
+		{
+			"iso8601 with a space and no zone", TIMESTAMP_ISO8601, "",
+			"2024-02-01 10:00:00 [error] Failed password",
+			time.Date(2024, time.February, 1, 10, 0, 0, 0, time.Local), true,
+		},
+		{
+			"iso8601 with a space and a compact offset", TIMESTAMP_ISO8601, "",
+			"2024-02-01 10:00:00+0200 [error] Failed password",
+			time.Date(2024, time.February, 1, 10, 0, 0, 0, plus2), true,
+		},
+		{
+			"common", TIMESTAMP_COMMON, "",
+			`192.0.2.1 - - [01/Feb/2024:10:00:00 +0200] "GET / HTTP/1.1" 401 0`,
+			time.Date(2024, time.February, 1, 10, 0, 0, 0, plus2), true,
+		},
+		{
+			"layout with a Z zone", "2006-01-02T15:04:05Z07:00", "",
+			"2024-02-01T10:00:00Z Failed password",
+			time.Date(2024, time.February, 1, 10, 0, 0, 0, time.UTC), true,
+		},
+		{
+			"layout with an offset instead of Z", "2006-01-02T15:04:05Z07:00", "",
+			"2024-02-01T10:00:00+02:00 Failed password",
+			time.Date(2024, time.February, 1, 10, 0, 0, 0, plus2), true,
+		},
+		{
+			"layout with a fraction", "2006/01/02 15:04:05.000", "",
+			"2024/02/01 10:00:00.123 [error] Failed password",
+			time.Date(2024, time.February, 1, 10, 0, 0, 123000000, time.Local), true,
+		},
+		{
+			"layout with an optional fraction", "2006/01/02 15:04:05.999", "",
+			"2024/02/01 10:00:00 [error] Failed password",
+			time.Date(2024, time.February, 1, 10, 0, 0, 0, time.Local), true,
+		},
+		{
+			"layout without the fraction of the value", "2006/01/02 15:04:05", "",
+			"2024/02/01 10:00:00.123456 [error] Failed password",
+			time.Date(2024, time.February, 1, 10, 0, 0, 123456000, time.Local), true,
+		},
+		{
+			"layout with the full month", "January _2 2006 15:04:05", "",
+			"February  1 2024 10:00:00 Failed password",
+			time.Date(2024, time.February, 1, 10, 0, 0, 0, time.Local), true,
+		},
+		{
+			"layout with a space padded day", "_2/01/2006 15:04:05", "",
+			" 1/02/2024 10:00:00 Failed password",
+			time.Date(2024, time.February, 1, 10, 0, 0, 0, time.Local), true,
+		},
+		{
+			"layout with a zone name", "Mon Jan _2 15:04:05 MST 2006", "",
+			"Thu Feb  1 10:00:00 UTC 2024 Failed password",
+			time.Date(2024, time.February, 1, 10, 0, 0, 0, time.UTC), true,
+		},
+		{
+			"layout located by a regexp", "2006/01/02 15:04:05", `^\S+ (\S+ \S+)`,
+			"host 2024/02/01 10:00:00 Failed password",
+			time.Date(2024, time.February, 1, 10, 0, 0, 0, time.Local), true,
+		},
+		{
+			"layout not at the start", "2006/01/02 15:04:05", "",
+			"host 2024/02/01 10:00:00 Failed password",
+			time.Time{}, false,
+		},
+		{
+			"no timestamp", TIMESTAMP_SYSLOG, "",
+			"Failed password",
+			time.Time{}, false,
+		},
+		{
+			"invalid date", TIMESTAMP_RFC5424, "",
+			"2024-02-31T10:00:00Z Failed password",
+			time.Time{}, false,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			timestamp, err := NewTimestamp(test.format, test.regexp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			when, found := timestamp.Parse(test.line, now)
+			if found != test.found || !when.Equal(test.want) {
+				t.Errorf("Parse = %s, %t; want %s, %t", when, found, test.want, test.found)
+			}
+		})
+	}
+}
+
+func TestNewTimestampUnknownFormat(t *testing.T) {
+	_, err := NewTimestamp("apache", "")
+	if err == nil {
+		t.Error("unknown format accepted")
+	}
+}
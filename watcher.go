@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"golang.org/x/sys/unix"
+	"sync"
+)
+
+// EVENTS_BUFFER is how many events wait for a busy source before the
+// watcher waits for it.
+const EVENTS_BUFFER = 64
+
+// Watcher owns the inotify instance shared by all the sources and dispatches
+// the events to the sources watching the files they are about.
+// A file, or directory, watched by more than one source has a single watch,
+// as inotify returns the same watch descriptor for the same inode.
+// The log files are opened once too, and what is written to them read once
+// for all the sources following them, each from its own position.
+type Watcher struct {
+	sync.Mutex
+	fd int
+	// wake is the pipe waking the watcher up when it is closed.
+	wake [2]int
+	// watches are the sources interested in each watch descriptor.
+	watches     map[int]map[*Source]bool
+	subscribers map[*Source]*subscriber
+	// files are the log files open, by device and inode.
+	files  map[[2]uint64]*sharedFile
+	closed bool
+}
+
+// subscriber is where the events for a source go; done is closed when the
+// source stops reading them.
+type subscriber struct {
+	events chan inotifyEvent
+	done   chan struct{}
+}
+
+// NewWatcher returns a watcher with its inotify instance.
+func NewWatcher() (*Watcher, error) {
+	w := &Watcher{
+		watches:     make(map[int]map[*Source]bool),
+		subscribers: make(map[*Source]*subscriber),
+		files:       make(map[[2]uint64]*sharedFile),
+	}
+	/*
+		inotify_init(2)
+		inotify_init() initializes a new inotify instance and returns a file
+		descriptor associated with a new inotify event queue.
+	*/
+	var err error
+	w.fd, err = unix.InotifyInit1(unix.IN_NONBLOCK | unix.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	err = unix.Pipe2(w.wake[:], unix.O_NONBLOCK|unix.O_CLOEXEC)
+	if err != nil {
+		unix.Close(w.fd)
+		return nil, err
+	}
+	return w, nil
+}
+
+// Subscribe returns the channel of the events for the source, closed when
+// the watcher stops.
+func (w *Watcher) Subscribe(source *Source) <-chan inotifyEvent {
+	w.Lock()
+	defer w.Unlock()
+	s := &subscriber{
+		events: make(chan inotifyEvent, EVENTS_BUFFER),
+		done:   make(chan struct{}),
+	}
+	if w.closed {
+		close(s.events)
+		return s.events
+	}
+	w.subscribers[source] = s
+	return s.events
+}
+
+// Unsubscribe removes the watches of the source, which is no longer sent
+// events.
+func (w *Watcher) Unsubscribe(source *Source) {
+	w.Lock()
+	defer w.Unlock()
+	for wd := range w.watches {
+		w.remove(source, wd)
+	}
+	if s, found := w.subscribers[source]; found {
+		close(s.done)
+		delete(w.subscribers, source)
+	}
+}
+
+// Add watches the file, or directory, for the given events on behalf of the
+// source and returns the watch descriptor.
+func (w *Watcher) Add(source *Source, path string, mask uint32) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	if w.closed {
+		return -1, errors.New("watcher closed")
+	}
+	/*
+		inotify_add_watch(2)
+		inotify_add_watch() adds a new watch, or modifies an existing watch,
+		for the file whose location is specified in pathname; [...]
+		The fd argument is a file descriptor referring to the inotify instance
+		whose watch list is to be modified.
+		The events to be monitored for pathname are specified in the mask
+		bit-mask argument.
+		See inotify(7) for a description of the bits that can be set in mask.
+	*/
+	// The events of another source on the same inode are kept.
+	wd, err := unix.InotifyAddWatch(w.fd, path, mask|unix.IN_MASK_ADD)
+	if err != nil {
+		return -1, err
+	}
+	if w.watches[wd] == nil {
+		w.watches[wd] = make(map[*Source]bool)
+	}
+	w.watches[wd][source] = true
+	return wd, nil
+}
+
+// Remove drops the watch of the source; the watch is removed when no source
+// is left.
+func (w *Watcher) Remove(source *Source, wd int) {
+	w.Lock()
+	defer w.Unlock()
+	w.remove(source, wd)
+}
+
+// remove drops the watch of the source; the caller must hold the lock.
+func (w *Watcher) remove(source *Source, wd int) {
+	sources, found := w.watches[wd]
+	if !found || !sources[source] {
+		return
+	}
+	delete(sources, source)
+	if len(sources) > 0 {
+		return
+	}
+	delete(w.watches, wd)
+	if !w.closed {
+		// The watch is already gone if the file was deleted.
+		unix.InotifyRmWatch(w.fd, uint32(wd))
+	}
+}
+
+// Run reads the events and dispatches them until the watcher is closed, or
+// reading fails; the channels of the sources are closed then.
+func (w *Watcher) Run() error {
+	defer w.stop()
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	fds := []unix.PollFd{
+		{Fd: int32(w.fd), Events: unix.POLLIN},
+		{Fd: int32(w.wake[0]), Events: unix.POLLIN},
+	}
+	for {
+		_, err := unix.Poll(fds, -1)
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if fds[1].Revents != 0 {
+			return nil
+		}
+		events, err := readEvents(w.fd, buf)
+		if errors.Is(err, unix.EAGAIN) {
+			continue
+		}
+		for _, event := range events {
+			w.dispatch(event)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// dispatch sends the event to the sources watching the file; an overflow of
+// the queue goes to every source.
+func (w *Watcher) dispatch(event inotifyEvent) {
+	w.Lock()
+	var subscribers []*subscriber
+	for source, s := range w.subscribers {
+		if event.Mask&unix.IN_Q_OVERFLOW != 0 || w.watches[event.Watch][source] {
+			subscribers = append(subscribers, s)
+		}
+	}
+	// The kernel removed the watch.
+	if event.Mask&unix.IN_IGNORED != 0 {
+		delete(w.watches, event.Watch)
+	}
+	w.Unlock()
+	for _, s := range subscribers {
+		select {
+		case s.events <- event:
+		case <-s.done:
+		}
+	}
+}
+
+// Close stops the watcher.
+func (w *Watcher) Close() {
+	w.Lock()
+	defer w.Unlock()
+	if w.closed {
+		return
+	}
+	unix.Write(w.wake[1], []byte{0})
+}
+
+// stop closes the inotify instance and the channels of the sources.
+func (w *Watcher) stop() {
+	w.Lock()
+	defer w.Unlock()
+	w.closed = true
+	for source, s := range w.subscribers {
+		close(s.events)
+		delete(w.subscribers, source)
+	}
+	w.watches = make(map[int]map[*Source]bool)
+	unix.Close(w.fd)
+	unix.Close(w.wake[0])
+	unix.Close(w.wake[1])
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WHITELIST_CHECK_INTERVAL is how often the whitelist files are checked for
+// changes.
+const WHITELIST_CHECK_INTERVAL = 5 * time.Second
+
+// Whitelist is a list of networks whose addresses must never be blacklisted.
+// Besides the networks given in the configuration, it can read them from
+// files, which are reloaded when they change on disk.
+type Whitelist struct {
+	sync.Mutex
+	// Parent is a whitelist that is checked too (e.g. the global one).
+	Parent *Whitelist
+	// Warningf reports the problems found when reloading a file.
+	Warningf func(format string, args ...any)
+	networks []*net.IPNet
+	files    []*whitelistFile
+}
+
+// whitelistFile is a file of whitelisted addresses and networks.
+type whitelistFile struct {
+	Name     string
+	ModTime  time.Time
+	Size     int64
+	networks []*net.IPNet
+	// checked is when the file was last looked at for changes.
+	checked time.Time
+	// failure is the last error reloading the file, reported only once.
+	failure string
+}
+
+// NewWhitelist returns a whitelist with the given entries and files.
+// The invalid entries are skipped and returned as errors.
+func NewWhitelist(entries []string, files []string, warningf func(string, ...any)) (*Whitelist, []error) {
+	var errs []error
+	w := &Whitelist{Warningf: warningf}
+	for _, entry := range entries {
+		network, err := parseNetwork(entry)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("whitelist: %w", err))
+			continue
+		}
+		w.networks = append(w.networks, network)
+	}
+	for _, name := range files {
+		file := &whitelistFile{Name: name}
+		err := file.load()
+		if file.failed(err) {
+			errs = append(errs, fmt.Errorf("whitelist: %w", err))
+		}
+		w.files = append(w.files, file)
+	}
+	return w, errs
+}
+
+// Overlaps returns true if any address of the given network is whitelisted.
+func (w *Whitelist) Overlaps(network *net.IPNet) bool {
+	if w == nil {
+		return false
+	}
+	w.Lock()
+	found := overlaps(w.networks, network)
+	for _, file := range w.files {
+		if found {
+			break
+		}
+		err := file.reload()
+		if err != nil && w.Warningf != nil {
+			w.Warningf("could not reload whitelist: %s", err.Error())
+		}
+		found = overlaps(file.networks, network)
+	}
+	w.Unlock()
+	return found || w.Parent.Overlaps(network)
+}
+
+// load reads the networks in the file, one per line; empty lines and
+// anything after a # are ignored.
+// The networks already loaded are kept if the file cannot be read.
+func (file *whitelistFile) load() error {
+	f, err := os.Open(file.Name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fileInfo, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	var networks []*net.IPNet
+	var errs []string
+	scanner := bufio.NewScanner(f)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		network, err := parseNetwork(line)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("line %d: %s", n, err.Error()))
+			continue
+		}
+		networks = append(networks, network)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%s: %w", file.Name, err)
+	}
+	file.networks = networks
+	file.ModTime = fileInfo.ModTime()
+	file.Size = fileInfo.Size()
+	if len(errs) > 0 {
+		return fmt.Errorf("%s: %s", file.Name, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// reload loads the file again if it has changed since the last time; it is
+// looked at once every WHITELIST_CHECK_INTERVAL at most, not on every lookup.
+// An error is returned only when it is a new one, so that a missing file is
+// not reported on every lookup.
+func (file *whitelistFile) reload() error {
+	now := time.Now()
+	if now.Sub(file.checked) < WHITELIST_CHECK_INTERVAL {
+		return nil
+	}
+	file.checked = now
+	err := file.update()
+	if !file.failed(err) {
+		return nil
+	}
+	return err
+}
+
+// update loads the file if it has changed since the last time.
+func (file *whitelistFile) update() error {
+	fileInfo, err := os.Stat(file.Name)
+	if err != nil {
+		return err
+	}
+	if fileInfo.ModTime().Equal(file.ModTime) && fileInfo.Size() == file.Size {
+		return nil
+	}
+	return file.load()
+}
+
+// failed records the outcome of loading the file and returns true if it is
+// a new error.
+func (file *whitelistFile) failed(err error) bool {
+	if err == nil {
+		file.failure = ""
+		return false
+	}
+	if err.Error() == file.failure {
+		return false
+	}
+	file.failure = err.Error()
+	return true
+}
+
+// parseNetwork parses an address or a network in CIDR notation; a single
+// address is a network with a full mask.
+func parseNetwork(entry string) (*net.IPNet, error) {
+	entry = strings.TrimSpace(entry)
+	if strings.Contains(entry, "/") {
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", entry)
+		}
+		return network, nil
+	}
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", entry)
+	}
+	return hostNetwork(ip), nil
+}
+
+// overlaps returns true if any of the networks has addresses in common with
+// the given one; as networks are either nested or disjoint, it is enough to
+// check if either contains the first address of the other.
+func overlaps(networks []*net.IPNet, other *net.IPNet) bool {
+	for _, network := range networks {
+		if network.Contains(other.IP) || other.Contains(network.IP) {
+			return true
+		}
+	}
+	return false
+}